@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"sync"
+)
+
+// BatchRequest describes one generation within a batch.
+type BatchRequest struct {
+	Starter string `json:"starter"`
+	Length  int    `json:"length"`
+	// Seed is optional; when it is missing or negative a seed is picked
+	// and reported back in the matching BatchResult.
+	Seed *int64 `json:"seed,omitempty"`
+}
+
+// BatchResult is the outcome of one BatchRequest.
+type BatchResult struct {
+	Text string `json:"text"`
+	Seed int64  `json:"seed"`
+}
+
+// GenerateBatch runs every request against the chain concurrently and
+// returns the results in the same order as the requests. Requests without
+// a seed get consecutive seeds from a single time-based base, so two of
+// them never end up with the same seed by starting at the same instant.
+func (mc *MarkovChain) GenerateBatch(reqs []BatchRequest) []BatchResult {
+	results := make([]BatchResult, len(reqs))
+
+	// Settle every seed before fanning out
+	base := ResolveSeed(-1)
+	for i, req := range reqs {
+		if req.Seed != nil && *req.Seed >= 0 {
+			results[i].Seed = *req.Seed
+		} else {
+			results[i].Seed = (base + int64(i)) & (1<<63 - 1)
+		}
+	}
+
+	// Generate with at most one worker per CPU; Generate only reads the
+	// chain, so the workers can share it
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, runtime.NumCPU())
+	for i, req := range reqs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, req BatchRequest) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i].Text = mc.Generate(req.Length, results[i].Seed, req.Starter)
+		}(i, req)
+	}
+	wg.Wait()
+
+	return results
+}
+
+// runBatch implements the "batch" subcommand: train a chain once, then
+// answer a JSON array of generation requests with a JSON array of results.
+func runBatch(args []string) {
+	fs := flag.NewFlagSet("batch", flag.ExitOnError)
+	k := fs.Int("k", 1, "Order of the Markov chain")
+	inputFile := fs.String("i", "", "Input file (optional, reads from stdin if not provided)")
+	requestsFile := fs.String("requests", "", "JSON file holding an array of {\"starter\", \"length\", \"seed\"} requests")
+	newlines := fs.String("newlines", "lf", "Newline handling for training text: preserve, lf, normalize or boundary")
+	fs.Parse(args)
+
+	mode, err := ParseNewlineMode(*newlines)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if *requestsFile == "" {
+		fmt.Fprintf(os.Stderr, "Error: -requests is required\n")
+		os.Exit(1)
+	}
+
+	data, err := os.ReadFile(*requestsFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading requests: %v\n", err)
+		os.Exit(1)
+	}
+	var reqs []BatchRequest
+	if err := json.Unmarshal(data, &reqs); err != nil {
+		fmt.Fprintf(os.Stderr, "Error parsing requests: %v\n", err)
+		os.Exit(1)
+	}
+
+	text, err := readInput(*inputFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading input: %v\n", err)
+		os.Exit(1)
+	}
+
+	mc := NewMarkovChain(*k)
+	mc.AddTextNewlines(text, mode)
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(mc.GenerateBatch(reqs)); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing results: %v\n", err)
+		os.Exit(1)
+	}
+}
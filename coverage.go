@@ -0,0 +1,189 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+)
+
+// StateCount pairs a state with how many transitions leave it in training.
+type StateCount struct {
+	State string
+	Count int
+}
+
+// CoverageReport describes how much of the training material generation
+// can actually reach. Reachability follows transitions from the start
+// states through states seen in training, ignoring the random jump the
+// generator makes at a dead end. The walk figures come from simulated
+// generations, jumps included.
+type CoverageReport struct {
+	// StartStates is how many states generation may start from.
+	StartStates int
+	// TotalStates and TotalNgrams count the distinct states and distinct
+	// (state, next character) pairs seen in training.
+	TotalStates int
+	TotalNgrams int
+	// ReachableStates and ReachableNgrams count those reachable from the
+	// start states.
+	ReachableStates int
+	ReachableNgrams int
+	// VisitedStates counts the distinct states the walks drew from, and
+	// UnvisitedWeight is the share of training transitions that leave a
+	// state the walks never visited.
+	VisitedStates   int
+	UnvisitedWeight float64
+	// Unvisited lists the states the walks never visited, the most
+	// frequent in training first.
+	Unvisited []StateCount
+}
+
+// Coverage analyses which parts of the chain generation reaches. Walks
+// run with opts, the way GenerateWith would, each with Length characters
+// and its own seed counting up from opts.Seed. The start states come from
+// opts too: the state at the end of Starter, or the states StartAfter
+// allows.
+func (mc *MarkovChain) Coverage(opts GenerateOptions, walks int) CoverageReport {
+	var report CoverageReport
+	report.TotalStates = len(mc.transitions)
+	for _, freq := range mc.counts() {
+		report.TotalNgrams += len(freq)
+	}
+
+	// The states generation starts from
+	var starts []string
+	if len(opts.Starter) >= mc.order {
+		starts = []string{opts.Starter[len(opts.Starter)-mc.order:]}
+	} else {
+		starts = mc.startStates(opts.StartAfter)
+	}
+	report.StartStates = len(starts)
+
+	// Breadth-first search over state-to-state transitions
+	reached := make(map[string]bool)
+	var queue []string
+	for _, state := range starts {
+		if _, ok := mc.transitions[state]; ok && !reached[state] {
+			reached[state] = true
+			queue = append(queue, state)
+		}
+	}
+	for len(queue) > 0 {
+		state := queue[0]
+		queue = queue[1:]
+		seen := make(map[rune]bool)
+		for _, r := range mc.transitions[state] {
+			if seen[r] {
+				continue
+			}
+			seen[r] = true
+			report.ReachableNgrams++
+			next := mc.nextState(state, r)
+			if _, ok := mc.transitions[next]; ok && !reached[next] {
+				reached[next] = true
+				queue = append(queue, next)
+			}
+		}
+	}
+	report.ReachableStates = len(reached)
+
+	// Simulated walks, recording every state the generator draws from
+	visited := make(map[string]bool)
+	walkOpts := opts
+	walkOpts.visit = func(state string) { visited[state] = true }
+	base := ResolveSeed(opts.Seed)
+	for i := 0; i < walks; i++ {
+		walkOpts.Seed = (base + int64(i)) & (1<<63 - 1)
+		mc.GenerateWith(walkOpts)
+	}
+
+	// Everything the walks missed, heaviest first
+	total, missed := 0, 0
+	for state := range mc.transitions {
+		n := mc.total(state)
+		total += n
+		if visited[state] {
+			report.VisitedStates++
+			continue
+		}
+		missed += n
+		report.Unvisited = append(report.Unvisited, StateCount{State: state, Count: n})
+	}
+	sort.Slice(report.Unvisited, func(i, j int) bool {
+		a, b := report.Unvisited[i], report.Unvisited[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		return a.State < b.State
+	})
+	if total > 0 {
+		report.UnvisitedWeight = float64(missed) / float64(total)
+	}
+
+	return report
+}
+
+// percent formats part/whole as a percentage.
+func percent(part, whole int) string {
+	if whole == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f%%", 100*float64(part)/float64(whole))
+}
+
+// runCoverage implements the "coverage" subcommand: report how much of the
+// trained chain is reachable and visited when generating, and which states
+// never come up.
+func runCoverage(args []string) {
+	fs := flag.NewFlagSet("coverage", flag.ExitOnError)
+	k := fs.Int("k", 1, "Order of the Markov chain")
+	inputFile := fs.String("i", "", "Input file (optional, reads from stdin if not provided)")
+	newlines := fs.String("newlines", "lf", "Newline handling for training text: preserve, lf, normalize or boundary")
+	walks := fs.Int("walks", 200, "Number of simulated generations")
+	l := fs.Int("l", 200, "Number of characters in each simulated generation")
+	seedFlag := fs.Int64("seed", -1, "Random seed of the first walk (optional, defaults to current time if not provided)")
+	starter := fs.String("starter", "", "Starter text every walk begins with")
+	startAfter := fs.String("start-after", `\n`, `Start walks only from states ending in one of these characters (accepts \n, \t, \r)`)
+	top := fs.Int("top", 20, "Number of unvisited states to list")
+	fs.Parse(args)
+
+	mode, err := ParseNewlineMode(*newlines)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	text, err := readInput(*inputFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading input: %v\n", err)
+		os.Exit(1)
+	}
+
+	mc := NewMarkovChain(*k)
+	mc.AddTextNewlines(text, mode)
+
+	report := mc.Coverage(GenerateOptions{
+		Length:     *l,
+		Seed:       *seedFlag,
+		Starter:    *starter,
+		StartAfter: unescapeFlag(*startAfter),
+	}, *walks)
+
+	fmt.Printf("start states:      %d\n", report.StartStates)
+	fmt.Printf("reachable states:  %d/%d (%s)\n", report.ReachableStates, report.TotalStates, percent(report.ReachableStates, report.TotalStates))
+	fmt.Printf("reachable n-grams: %d/%d (%s)\n", report.ReachableNgrams, report.TotalNgrams, percent(report.ReachableNgrams, report.TotalNgrams))
+	fmt.Printf("visited states:    %d/%d (%s) in %d walks of %d characters\n", report.VisitedStates, report.TotalStates, percent(report.VisitedStates, report.TotalStates), *walks, *l)
+	fmt.Printf("training transitions from unvisited states: %.1f%%\n", 100*report.UnvisitedWeight)
+
+	if len(report.Unvisited) > 0 && *top > 0 {
+		fmt.Println("most frequent unvisited states:")
+		for i, sc := range report.Unvisited {
+			if i == *top {
+				break
+			}
+			fmt.Printf("  %-16s %d\n", strconv.Quote(sc.State), sc.Count)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+)
+
+// DiversityThresholds decides when a model counts as degenerate. Such
+// models mostly replay their training text verbatim instead of producing
+// new combinations.
+type DiversityThresholds struct {
+	// MinStates is the fewest states a healthy model should have.
+	MinStates int
+	// MaxDeterministic is the largest acceptable share of transitions that
+	// leave a state with only one possible successor.
+	MaxDeterministic float64
+	// MinEntropy is the lowest acceptable average entropy, in bits, of the
+	// next character given the state.
+	MinEntropy float64
+}
+
+// DefaultDiversityThresholds are the thresholds the command-line tool uses.
+var DefaultDiversityThresholds = DiversityThresholds{
+	MinStates:        20,
+	MaxDeterministic: 0.8,
+	MinEntropy:       0.5,
+}
+
+// Warning is a structured diagnostic about a model. Code identifies the
+// check that failed, and Value is the measurement that crossed Threshold.
+type Warning struct {
+	Code      string  `json:"code"`
+	Message   string  `json:"message"`
+	Value     float64 `json:"value"`
+	Threshold float64 `json:"threshold"`
+}
+
+// String formats the warning for display.
+func (w Warning) String() string {
+	return fmt.Sprintf("%s: %s", w.Code, w.Message)
+}
+
+// Diversity measures how much choice the chain has. Both figures are
+// weighted by how often each state occurs in training, so rare states
+// cannot hide a chain that is deterministic where it matters. deterministic
+// is the share of transitions leaving a state with a single successor, and
+// entropy is the average entropy in bits of the next character.
+func (mc *MarkovChain) Diversity() (deterministic, entropy float64) {
+	total := 0
+	for state, freq := range mc.counts() {
+		n := mc.total(state)
+		total += n
+		if len(freq) == 1 {
+			deterministic += float64(n)
+		}
+		for _, c := range freq {
+			p := float64(c) / float64(n)
+			entropy -= float64(c) * math.Log2(p)
+		}
+	}
+	if total == 0 {
+		return 0, 0
+	}
+	return deterministic / float64(total), entropy / float64(total)
+}
+
+// CheckDiversity returns a warning for every threshold the chain fails,
+// or nil if the chain looks healthy.
+func (mc *MarkovChain) CheckDiversity(t DiversityThresholds) []Warning {
+	var warnings []Warning
+
+	states, _ := mc.Size()
+	if states < t.MinStates {
+		warnings = append(warnings, Warning{
+			Code:      "few-states",
+			Message:   fmt.Sprintf("model has only %d states (want at least %d)", states, t.MinStates),
+			Value:     float64(states),
+			Threshold: float64(t.MinStates),
+		})
+	}
+
+	// An empty model already got its warning above
+	if states == 0 {
+		return warnings
+	}
+
+	deterministic, entropy := mc.Diversity()
+	if deterministic > t.MaxDeterministic {
+		warnings = append(warnings, Warning{
+			Code:      "deterministic",
+			Message:   fmt.Sprintf("%.0f%% of transitions have only one possible next character (want at most %.0f%%)", deterministic*100, t.MaxDeterministic*100),
+			Value:     deterministic,
+			Threshold: t.MaxDeterministic,
+		})
+	}
+	if entropy < t.MinEntropy {
+		warnings = append(warnings, Warning{
+			Code:      "low-entropy",
+			Message:   fmt.Sprintf("average next-character entropy is %.2f bits (want at least %.2f)", entropy, t.MinEntropy),
+			Value:     entropy,
+			Threshold: t.MinEntropy,
+		})
+	}
+
+	return warnings
+}
+
+// warnDiversity prints the chain's diversity warnings, if any, to stderr.
+func warnDiversity(mc *MarkovChain) {
+	for _, w := range mc.CheckDiversity(DefaultDiversityThresholds) {
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", w)
+	}
+}
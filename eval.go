@@ -0,0 +1,267 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Smoothing turns the raw transition counts of a state into a probability
+// for one particular next character, reserving some mass for characters
+// that never followed the state in training.
+type Smoothing interface {
+	// Prob returns P(next | state), where count is how often next followed
+	// the state in training, total is how many transitions left the state,
+	// and vocab is the number of characters the distribution ranges over.
+	Prob(count, total, vocab int) float64
+}
+
+// AddK is additive smoothing: every character in the vocabulary gets K
+// pseudo-counts on top of what was observed. AddK(1) is Laplace smoothing,
+// AddK(0) leaves the raw maximum-likelihood estimate.
+type AddK float64
+
+// Prob implements Smoothing.
+func (k AddK) Prob(count, total, vocab int) float64 {
+	denom := float64(total) + float64(k)*float64(vocab)
+	if denom == 0 {
+		return 0
+	}
+	return (float64(count) + float64(k)) / denom
+}
+
+// Dirichlet smoothing treats each state's next-character distribution as
+// unknown, with a symmetric Dirichlet prior of concentration Alpha, and
+// uses the posterior mean: (count + Alpha) / (total + Alpha*V). Small Alpha
+// trusts the observed counts; large Alpha pulls every state towards
+// uniform. Unlike AddK, the distribution can range over a declared
+// Alphabet, and GenerateOptions can sample from it as well as score with it.
+type Dirichlet struct {
+	Alpha float64
+	// Alphabet, if not empty, lists characters the distribution ranges over
+	// on top of the training alphabet, with no unknown slot. Otherwise it
+	// is the training alphabet plus one unknown slot.
+	Alphabet string
+}
+
+// Prob implements Smoothing.
+func (d Dirichlet) Prob(count, total, vocab int) float64 {
+	return AddK(d.Alpha).Prob(count, total, vocab)
+}
+
+// support returns the characters a smoothed distribution ranges over, and
+// the vocabulary size used when scoring. The support is always the training
+// alphabet, so every observed transition stays possible. A declared
+// Dirichlet alphabet extends it and closes the vocabulary; otherwise the
+// vocabulary has one more slot that stands for every unknown character.
+func (mc *MarkovChain) support(s Smoothing) (runes []rune, vocab int) {
+	runes = mc.alphabet()
+	d, ok := s.(Dirichlet)
+	if !ok || d.Alphabet == "" {
+		return runes, len(runes) + 1
+	}
+	seen := make(map[rune]bool, len(runes))
+	for _, r := range runes {
+		seen[r] = true
+	}
+	for _, r := range d.Alphabet {
+		if !seen[r] {
+			seen[r] = true
+			runes = append(runes, r)
+		}
+	}
+	sort.Slice(runes, func(i, j int) bool { return runes[i] < runes[j] })
+	return runes, len(runes)
+}
+
+// counts tallies the transitions of every state, turning the flat rune
+// lists into per-state frequency tables.
+func (mc *MarkovChain) counts() map[string]map[rune]int {
+	table := make(map[string]map[rune]int, len(mc.transitions))
+	for state, nextRunes := range mc.transitions {
+		counts, pruned := mc.pruned[state]
+		freq := make(map[rune]int)
+		for i, r := range nextRunes {
+			if pruned {
+				freq[r] += counts[i]
+			} else {
+				freq[r]++
+			}
+		}
+		table[state] = freq
+	}
+	return table
+}
+
+// alphabet returns every character the chain has seen, either inside a
+// state or as a transition target, in ascending order.
+func (mc *MarkovChain) alphabet() []rune {
+	seen := make(map[rune]bool)
+	for state, nextRunes := range mc.transitions {
+		// States are built byte by byte in AddText, so read them the same way
+		for i := 0; i < len(state); i++ {
+			seen[rune(state[i])] = true
+		}
+		for _, r := range nextRunes {
+			seen[r] = true
+		}
+	}
+	runes := make([]rune, 0, len(seen))
+	for r := range seen {
+		runes = append(runes, r)
+	}
+	sort.Slice(runes, func(i, j int) bool { return runes[i] < runes[j] })
+	return runes
+}
+
+// Size reports how big the chain is: the number of distinct states and the
+// number of transitions seen in training (each observed occurrence counts
+// once, even in a pruned state that stores it as a count).
+func (mc *MarkovChain) Size() (states, transitions int) {
+	for state := range mc.transitions {
+		transitions += mc.total(state)
+	}
+	return len(mc.transitions), transitions
+}
+
+// total returns how many transitions leave state in training.
+func (mc *MarkovChain) total(state string) int {
+	counts, ok := mc.pruned[state]
+	if !ok {
+		return len(mc.transitions[state])
+	}
+	n := 0
+	for _, c := range counts {
+		n += c
+	}
+	return n
+}
+
+// scorer caches everything needed to assign smoothed probabilities to
+// transitions, so scoring long texts does not re-count the chain.
+type scorer struct {
+	order     int
+	counts    map[string]map[rune]int
+	totals    map[string]int
+	vocab     int
+	smoothing Smoothing
+}
+
+// newScorer prepares a scorer for the chain, with the vocabulary size
+// given by the smoothing's support.
+func (mc *MarkovChain) newScorer(s Smoothing) *scorer {
+	counts := mc.counts()
+	totals := make(map[string]int, len(counts))
+	for state := range mc.transitions {
+		totals[state] = mc.total(state)
+	}
+	_, vocab := mc.support(s)
+	return &scorer{
+		order:     mc.order,
+		counts:    counts,
+		totals:    totals,
+		vocab:     vocab,
+		smoothing: s,
+	}
+}
+
+// prob returns the smoothed probability of next following state. Unseen
+// states have a zero total, so they fall back to whatever the smoothing
+// gives an empty distribution.
+func (sc *scorer) prob(state string, next rune) float64 {
+	return sc.smoothing.Prob(sc.counts[state][next], sc.totals[state], sc.vocab)
+}
+
+// crossEntropy returns the total negative log2-probability of every
+// character in text that has a full state of context before it, along with
+// how many characters were scored.
+func (sc *scorer) crossEntropy(text string) (bits float64, n int) {
+	for i := sc.order; i < len(text); i++ {
+		p := sc.prob(text[i-sc.order:i], rune(text[i]))
+		bits -= math.Log2(p)
+		n++
+	}
+	return bits, n
+}
+
+// Perplexity returns the per-character perplexity of text under the chain,
+// using s to assign probability to transitions never seen in training.
+// Lower is better. The first 'order' characters of text only provide
+// context; if nothing is left to score, the result is NaN.
+func (mc *MarkovChain) Perplexity(text string, s Smoothing) float64 {
+	bits, n := mc.newScorer(s).crossEntropy(text)
+	if n == 0 {
+		return math.NaN()
+	}
+	return math.Exp2(bits / float64(n))
+}
+
+// SplitHoldout cuts text into a training part and a held-out part made of
+// the last 'fraction' of the text.
+func SplitHoldout(text string, fraction float64) (train, heldOut string) {
+	if fraction <= 0 {
+		return text, ""
+	}
+	if fraction >= 1 {
+		return "", text
+	}
+	cut := len(text) - int(float64(len(text))*fraction)
+	return text[:cut], text[cut:]
+}
+
+// CVResult summarises a k-fold cross-validation run.
+type CVResult struct {
+	// Perplexities holds the held-out perplexity of each fold, in order.
+	Perplexities []float64
+	// Mean is the average perplexity across folds.
+	Mean float64
+	// Variance is the sample variance across folds.
+	Variance float64
+}
+
+// CrossValidate splits text into 'folds' contiguous pieces and, for each
+// piece, trains a chain of the given order on the remaining pieces and
+// measures its perplexity on the piece that was left out. Each training
+// piece is added separately so no transitions span the gap left by the
+// held-out fold.
+func CrossValidate(text string, order, folds int, s Smoothing) (CVResult, error) {
+	if folds < 2 {
+		return CVResult{}, fmt.Errorf("need at least 2 folds, got %d", folds)
+	}
+	size := len(text) / folds
+	if size <= order {
+		return CVResult{}, fmt.Errorf("text too short for %d folds at order %d", folds, order)
+	}
+
+	// Fold boundaries; the last fold absorbs the remainder
+	pieces := make([]string, folds)
+	for f := 0; f < folds; f++ {
+		end := (f + 1) * size
+		if f == folds-1 {
+			end = len(text)
+		}
+		pieces[f] = text[f*size : end]
+	}
+
+	var result CVResult
+	for f := range pieces {
+		mc := NewMarkovChain(order)
+		for g, piece := range pieces {
+			if g != f {
+				mc.AddText(piece)
+			}
+		}
+		result.Perplexities = append(result.Perplexities, mc.Perplexity(pieces[f], s))
+	}
+
+	for _, p := range result.Perplexities {
+		result.Mean += p
+	}
+	result.Mean /= float64(folds)
+	for _, p := range result.Perplexities {
+		result.Variance += (p - result.Mean) * (p - result.Mean)
+	}
+	result.Variance /= float64(folds - 1)
+
+	return result, nil
+}
@@ -7,6 +7,7 @@ import (
 	"io"
 	"math/rand"
 	"os"
+	"sort"
 	"strings"
 	"time"
 )
@@ -15,7 +16,12 @@ import (
 type MarkovChain struct {
 	// transitions maps a state (string) to all possible next runes.
 	transitions map[string][]rune
-	order       int
+	// pruned holds the states PruneTopN has compacted. Their transitions
+	// list each next rune once, and pruned holds the matching counts.
+	pruned map[string][]int
+	order  int
+	// log, if set, receives every change made to the transitions.
+	log *TrainingLog
 }
 
 // NewMarkovChain initializes a MarkovChain of the specified order.
@@ -33,34 +39,287 @@ func (mc *MarkovChain) AddText(text string) {
 		return
 	}
 
+	// When logging, gather this call's changes into one batch
+	var deltas map[string]map[rune]int
+	if mc.log != nil {
+		deltas = make(map[string]map[rune]int)
+	}
+
 	// Build transitions by sliding over the text
 	for i := 0; i < len(text)-mc.order; i++ {
 		// Current state is the substring of length 'order'
 		state := text[i : i+mc.order]
 		// The next character after this state
 		nextChar := rune(text[i+mc.order])
-		mc.transitions[state] = append(mc.transitions[state], nextChar)
+		if _, ok := mc.pruned[state]; ok {
+			mc.adjust(state, nextChar, 1)
+		} else {
+			mc.transitions[state] = append(mc.transitions[state], nextChar)
+		}
+
+		if deltas != nil {
+			if deltas[state] == nil {
+				deltas[state] = make(map[rune]int)
+			}
+			deltas[state][nextChar]++
+		}
 	}
+
+	if deltas != nil {
+		mc.log.Record(deltas)
+	}
+}
+
+// ResolveSeed returns seed unchanged when it is non-negative, and otherwise
+// picks a fresh non-negative seed from the current time. Callers that want
+// to report the seed actually used should resolve it before generating.
+func ResolveSeed(seed int64) int64 {
+	if seed >= 0 {
+		return seed
+	}
+	return time.Now().UnixNano() & (1<<63 - 1)
+}
+
+// sortedStates lists every state in a fixed order, so that picking a
+// "random" state depends only on the seed and not on map iteration order.
+func (mc *MarkovChain) sortedStates() []string {
+	states := make([]string, 0, len(mc.transitions))
+	for state := range mc.transitions {
+		states = append(states, state)
+	}
+	sort.Strings(states)
+	return states
+}
+
+// GenerateOptions controls a single generation. Apart from Length, the
+// zero value of every field keeps the plain behaviour of Generate.
+type GenerateOptions struct {
+	// Length is the total output length, starter included. Output stops
+	// short of it only when a Stop character is generated or the chain
+	// runs out of transitions.
+	Length int
+	// Seed seeds the random source; a negative seed is replaced by one
+	// derived from the current time.
+	Seed int64
+	// Starter is copied to the start of the output, and generation
+	// continues from its last 'order' characters.
+	Starter string
+	// MinLength is how long the output must be before a Stop character
+	// may end it. Until then, Stop characters are held back from every
+	// state that has another successor, and one written anyway (because
+	// the state offers nothing else) does not end the output.
+	MinLength int
+	// Stop lists characters that end the output as soon as one is
+	// generated. The stop character is kept as the last character.
+	Stop string
+	// StartAfter, when the starter is too short to give a state, limits the
+	// random starting state to states ending in one of these characters,
+	// so output begins where the corpus would begin a new word or line.
+	StartAfter string
+	// MaxRepeat caps how many times in a row the same character may be
+	// output; once a run reaches the cap, that character is dropped from
+	// the next draw, unless it is all the state offers. The cap never
+	// ends the output early. Zero means no cap.
+	MaxRepeat int
+	// Smoothing, if set, samples every character of its support with its
+	// smoothed probability instead of only the observed transitions, so
+	// characters never seen after a state are possible too.
+	Smoothing Smoothing
+	// Temperature reshapes every draw: below 1 sticks to the likeliest
+	// characters, above 1 flattens towards uniform. Zero means 1, which
+	// leaves the distribution as trained.
+	Temperature float64
+	// StateTemperature, if set, can override Temperature for particular
+	// states, e.g. to be conservative after sentence-final punctuation and
+	// creative mid-word. It reports false (or a non-positive temperature)
+	// to keep the global one. See SuffixTemperatures for a map-based one.
+	StateTemperature func(state string) (float64, bool)
+
+	// visit, if set, is told every state a character is drawn from.
+	visit func(state string)
+}
+
+// startStates lists the states a generation may start from: those ending in
+// one of the 'after' characters, or every state if after is empty or no
+// state qualifies.
+func (mc *MarkovChain) startStates(after string) []string {
+	states := mc.sortedStates()
+	if after == "" {
+		return states
+	}
+	var starts []string
+	for _, state := range states {
+		if state != "" && strings.ContainsRune(after, rune(state[len(state)-1])) {
+			starts = append(starts, state)
+		}
+	}
+	if len(starts) == 0 {
+		return states
+	}
+	return starts
 }
 
 // Generate produces 'length' characters of text using the Markov chain,
 // optionally starting with a given 'starter' string. If the starter is
 // longer than 'length', it will be truncated to fit. The total output
 // will always be exactly 'length' characters (if enough transitions exist).
+// A negative seed is replaced by one derived from the current time; the
+// same chain, seed and arguments always produce the same output.
 func (mc *MarkovChain) Generate(length int, seed int64, starter string) string {
+	return mc.GenerateWith(GenerateOptions{Length: length, Seed: seed, Starter: starter})
+}
+
+// candidates returns the transitions of state minus any character that
+// excluded rejects. Sampling uniformly from what is left renormalizes the
+// distribution over the remaining characters.
+func (mc *MarkovChain) candidates(state string, excluded func(rune) bool) []rune {
+	nextRunes := mc.transitions[state]
+	if excluded == nil {
+		return nextRunes
+	}
+	var kept []rune
+	for _, r := range nextRunes {
+		if !excluded(r) {
+			kept = append(kept, r)
+		}
+	}
+	return kept
+}
+
+// distribution returns the characters that may follow state, minus any
+// that excluded rejects. Without smoothing these are the raw transitions,
+// to be drawn uniformly, and weights is nil, except for a pruned state,
+// whose distinct characters come weighted by their counts. With smoothing
+// they are the
+// support characters with a non-zero smoothed probability, and weights
+// holds those probabilities. A state never seen in training has no
+// distribution either way: a smoothed one would be uniform noise, and the
+// generator does better jumping to a known state.
+func (mc *MarkovChain) distribution(state string, excluded func(rune) bool, s Smoothing, support []rune, vocab int) (runes []rune, weights []float64) {
+	counts, pruned := mc.pruned[state]
+	if s == nil {
+		if !pruned {
+			return mc.candidates(state, excluded), nil
+		}
+		for i, r := range mc.transitions[state] {
+			if excluded == nil || !excluded(r) {
+				runes = append(runes, r)
+				weights = append(weights, float64(counts[i]))
+			}
+		}
+		return runes, weights
+	}
+	total := mc.total(state)
+	if total == 0 {
+		return nil, nil
+	}
+	freq := make(map[rune]int)
+	for i, r := range mc.transitions[state] {
+		if pruned {
+			freq[r] += counts[i]
+		} else {
+			freq[r]++
+		}
+	}
+	for _, r := range support {
+		if excluded != nil && excluded(r) {
+			continue
+		}
+		if p := s.Prob(freq[r], total, vocab); p > 0 {
+			runes = append(runes, r)
+			weights = append(weights, p)
+		}
+	}
+	return runes, weights
+}
+
+// sample draws one of runes, uniformly when weights is nil and otherwise
+// with probability proportional to its weight.
+func sample(rng *rand.Rand, runes []rune, weights []float64) rune {
+	if weights == nil {
+		return runes[rng.Intn(len(runes))]
+	}
+	sum := 0.0
+	for _, w := range weights {
+		sum += w
+	}
+	x := rng.Float64() * sum
+	for i, w := range weights {
+		x -= w
+		if x < 0 {
+			return runes[i]
+		}
+	}
+	// Rounding can leave a sliver at the very end
+	return runes[len(runes)-1]
+}
+
+// GenerateWith produces text like Generate, with the extra controls
+// described by GenerateOptions.
+func (mc *MarkovChain) GenerateWith(opts GenerateOptions) string {
+	return walk(mc, opts)
+}
+
+// walker is what the generation loop draws from. MarkovChain and Mixture
+// both implement it, so every GenerateOptions control works the same way
+// for either.
+type walker interface {
+	// walkOrder is the length of the states the walk moves through.
+	walkOrder() int
+	// trained reports whether there is anything to generate from.
+	trained() bool
+	// known reports whether state has successors to draw from.
+	known(state string) bool
+	sortedStates() []string
+	startStates(after string) []string
+	// sampler prepares the draws of one walk smoothed by s. Each draw
+	// returns what may follow a state, minus what excluded rejects, as
+	// distribution does.
+	sampler(s Smoothing) func(state string, excluded func(rune) bool) ([]rune, []float64)
+	nextState(state string, nextChar rune) string
+}
+
+// walkOrder implements walker.
+func (mc *MarkovChain) walkOrder() int {
+	return mc.order
+}
+
+// trained implements walker.
+func (mc *MarkovChain) trained() bool {
+	return len(mc.transitions) > 0
+}
+
+// known implements walker.
+func (mc *MarkovChain) known(state string) bool {
+	_, ok := mc.transitions[state]
+	return ok
+}
+
+// sampler implements walker.
+func (mc *MarkovChain) sampler(s Smoothing) func(state string, excluded func(rune) bool) ([]rune, []float64) {
+	var support []rune
+	var vocab int
+	if s != nil {
+		support, vocab = mc.support(s)
+	}
+	return func(state string, excluded func(rune) bool) ([]rune, []float64) {
+		return mc.distribution(state, excluded, s, support, vocab)
+	}
+}
+
+// walk is the generation loop behind every GenerateWith.
+func walk(w walker, opts GenerateOptions) string {
+	length, starter := opts.Length, opts.Starter
 	if length <= 0 {
 		return ""
 	}
 
-	// Seed the random number generator
-	if seed < 0 {
-		rand.Seed(time.Now().UnixNano())
-	} else {
-		rand.Seed(seed)
-	}
+	// Each call gets its own random source, so concurrent calls neither
+	// race on nor disturb each other's sequences
+	rng := rand.New(rand.NewSource(ResolveSeed(opts.Seed)))
 
 	// If we have no transitions, there's nothing to generate.
-	if len(mc.transitions) == 0 {
+	if !w.trained() {
 		// Return just the truncated starter, if any.
 		if len(starter) > length {
 			return starter[:length]
@@ -82,18 +341,27 @@ func (mc *MarkovChain) Generate(length int, seed int64, starter string) string {
 	// We'll generate enough characters to reach 'length' total
 	needed := length - len(starter)
 
+	// A smoothed distribution ranges over the same support at every step
+	draw := w.sampler(opts.Smoothing)
+
+	// Track the run of identical characters at the end of the output,
+	// starting with the one the starter ends on
+	var lastChar rune
+	run := 0
+	for i := len(starter) - 1; i >= 0 && starter[i] == starter[len(starter)-1]; i-- {
+		lastChar = rune(starter[i])
+		run++
+	}
+
 	// Compute the initial state from the starter, if possible
 	var currentState string
-	if len(starter) >= mc.order {
+	if order := w.walkOrder(); len(starter) >= order {
 		// Use the last 'order' characters of starter
-		currentState = starter[len(starter)-mc.order:]
+		currentState = starter[len(starter)-order:]
 	} else {
 		// If not enough characters in the starter, pick a random state
-		var states []string
-		for state := range mc.transitions {
-			states = append(states, state)
-		}
-		currentState = states[rand.Intn(len(states))]
+		states := w.startStates(opts.StartAfter)
+		currentState = states[rng.Intn(len(states))]
 		// Also append currentState if we don't have a starter,
 		// but that would count toward the result. For simplicity,
 		// we won't add it in the result right now, because we
@@ -103,59 +371,95 @@ func (mc *MarkovChain) Generate(length int, seed int64, starter string) string {
 
 	// Now generate the remaining characters
 	for i := 0; i < needed; i++ {
-		// Possible next runes from currentState
-		nextRunes := mc.transitions[currentState]
-		if len(nextRunes) == 0 {
-			// No known transitions from this state, pick a random new one
-			var states []string
-			for s := range mc.transitions {
-				states = append(states, s)
+		// Stop characters are held back until the output, including
+		// the one about to be written, reaches the minimum length, and a
+		// character whose run has hit the cap sits out the next draw
+		early := len(starter)+i+1 < opts.MinLength
+		holdStop := opts.Stop != "" && early
+		capped := opts.MaxRepeat > 0 && run >= opts.MaxRepeat
+		var excluded func(rune) bool
+		if holdStop || capped {
+			excluded = func(r rune) bool {
+				return (holdStop && strings.ContainsRune(opts.Stop, r)) || (capped && r == lastChar)
 			}
-			currentState = states[rand.Intn(len(states))]
+		}
+
+		// A state never seen in training is a dead end: pick a random new one
+		if !w.known(currentState) {
+			states := w.sortedStates()
+			currentState = states[rng.Intn(len(states))]
 			// Write currentState to continue generation
 			// but we only want to write one character to the result, not the entire state.
 			// We'll pick a single random nextChar from that new state's transitions, if possible.
-			nextRunes = mc.transitions[currentState]
-			if len(nextRunes) == 0 {
-				// If even this new state has no transitions, we're stuck
-				break
-			}
 		}
-		nextChar := nextRunes[rand.Intn(len(nextRunes))]
+
+		// Possible next runes from currentState
+		nextRunes, weights := draw(currentState, excluded)
+		if len(nextRunes) == 0 && holdStop {
+			// A stop character is all this state offers: write it rather
+			// than splice the output onto an unrelated state
+			holdStop = false
+			nextRunes, weights = draw(currentState, excluded)
+		}
+		if len(nextRunes) == 0 && capped {
+			// Likewise when the capped character is the only successor:
+			// the run goes one over the cap for this draw
+			capped = false
+			nextRunes, weights = draw(currentState, excluded)
+		}
+		if len(nextRunes) == 0 {
+			// If even this new state has no transitions, we're stuck
+			break
+		}
+		if opts.visit != nil {
+			opts.visit(currentState)
+		}
+
+		// Reshape the draw for this state's temperature
+		if t := opts.temperatureFor(currentState); t != 1 {
+			nextRunes, weights = applyTemperature(nextRunes, weights, t)
+		}
+		nextChar := sample(rng, nextRunes, weights)
 		result.WriteRune(nextChar)
 
-		// Update currentState by dropping the first character and adding the new one
-		if mc.order > 1 {
-			if len(currentState) > 0 {
-				currentState = currentState[1:] + string(nextChar)
-			} else {
-				// If for some reason currentState is empty, just set to new char
-				currentState = string(nextChar)
-			}
+		if nextChar == lastChar {
+			run++
 		} else {
-			currentState = string(nextChar)
+			lastChar, run = nextChar, 1
 		}
+
+		// A stop character ends the output once the minimum is reached
+		if !early && strings.ContainsRune(opts.Stop, nextChar) {
+			break
+		}
+
+		currentState = w.nextState(currentState, nextChar)
 	}
 
 	return result.String()
 }
 
-func main() {
-	// Define command-line flags
-	k := flag.Int("k", 1, "Order of the Markov chain")
-	l := flag.Int("l", 100, "Number of characters to generate (total output length)")
-	inputFile := flag.String("i", "", "Input file (optional, reads from stdin if not provided)")
-	seedFlag := flag.Int64("seed", -1, "Random seed (optional, defaults to current time if not provided)")
-	starter := flag.String("starter", "", "Starter text to prepend to the output")
-	flag.Parse()
+// nextState returns the state that follows state once nextChar is output.
+func (mc *MarkovChain) nextState(state string, nextChar rune) string {
+	// Update the state by dropping the first character and adding the new one
+	if mc.order > 1 {
+		if len(state) > 0 {
+			return state[1:] + string(nextChar)
+		}
+		// If for some reason the state is empty, just set to new char
+		return string(nextChar)
+	}
+	return string(nextChar)
+}
 
-	// Read the input text from file or stdin
+// readInput returns the entire contents of the named file, or of stdin
+// when path is empty.
+func readInput(path string) (string, error) {
 	var reader io.Reader
-	if *inputFile != "" {
-		f, err := os.Open(*inputFile)
+	if path != "" {
+		f, err := os.Open(path)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error opening file %s: %v\n", *inputFile, err)
-			os.Exit(1)
+			return "", err
 		}
 		defer f.Close()
 		reader = f
@@ -174,17 +478,300 @@ func main() {
 	}
 
 	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+
+	return builder.String(), nil
+}
+
+func main() {
+	// Subcommands get their own flag sets; anything else is a plain generation run.
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "sweep":
+			runSweep(os.Args[2:])
+			return
+		case "blend":
+			runBlend(os.Args[2:])
+			return
+		case "coverage":
+			runCoverage(os.Args[2:])
+			return
+		case "batch":
+			runBatch(os.Args[2:])
+			return
+		case "stream":
+			runStream(os.Args[2:])
+			return
+		case "publish":
+			runPublish(os.Args[2:])
+			return
+		case "list":
+			runList(os.Args[2:])
+			return
+		case "snapshot":
+			runSnapshot(os.Args[2:])
+			return
+		}
+	}
+
+	// Define command-line flags
+	k := flag.Int("k", 1, "Order of the Markov chain")
+	l := flag.Int("l", 100, "Number of characters to generate (total output length)")
+	inputFile := flag.String("i", "", "Input file (optional, reads from stdin if not provided)")
+	seedFlag := flag.Int64("seed", -1, "Random seed (optional, defaults to current time if not provided)")
+	starter := flag.String("starter", "", "Starter text to prepend to the output")
+	cvFolds := flag.Int("cv", 0, "Run k-fold cross-validation with this many folds and report perplexity instead of generating")
+	addK := flag.Float64("addk", 1, "Additive smoothing used when scoring unseen transitions (with -cv)")
+	alpha := flag.Float64("alpha", 0, "Dirichlet prior concentration; when set, smooths both sampling and scoring (replaces -addk)")
+	alphabet := flag.String("alphabet", "", `Characters the Dirichlet prior ranges over on top of the training alphabet (accepts \n, \t, \r)`)
+	printSeed := flag.Bool("print-seed", false, "Print the seed used to stderr, so a run can be reproduced with -seed")
+	modelRef := flag.String("model", "", "Generate from a published model (name, name@version or name@latest) instead of training")
+	registryDir := flag.String("registry", "models", "Registry directory used with -model")
+	snapshotName := flag.String("snapshot", "", "Generate from a saved snapshot instead of training")
+	snapshotDir := flag.String("snapshot-dir", "snapshots", "Snapshot directory used with -snapshot")
+	trainLog := flag.String("train-log", "", "Append every trained transition to this log file")
+	replayLog := flag.String("replay", "", "Rebuild the chain (of order -k) from a training log instead of training")
+	topN := flag.Int("top-n", 0, "Keep only the N most frequent next characters of each state (0 keeps all)")
+	temp := flag.Float64("temp", 1, "Sampling temperature: below 1 is more conservative, above 1 more creative")
+	stateTemps := stateTempFlag{}
+	flag.Var(stateTemps, "state-temp", `Temperature for states ending in SUFFIX, as SUFFIX=T (repeatable; accepts \n, \t, \r)`)
+	presetName := flag.String("preset", "", "Preset bundle of settings: "+strings.Join(PresetNames(), ", "))
+	minLen := flag.Int("min", 0, "Minimum output length before a -stop character may end it")
+	maxRepeat := flag.Int("max-repeat", 0, "Maximum times the same character may repeat consecutively (0 for no limit)")
+	postFlag := flag.String("post", "", "Comma-separated post-processing steps applied to the output: "+strings.Join(PostStepNames(), ", "))
+	stop := flag.String("stop", "", `Characters that end the output once -min is reached (accepts \n, \t, \r)`)
+	newlines := flag.String("newlines", "lf", "Newline handling for training text: preserve, lf, normalize or boundary")
+	flag.Parse()
+
+	// Escapes are only needed for values typed on the command line
+	stopChars := unescapeFlag(*stop)
+
+	mode, err := ParseNewlineMode(*newlines)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	post, err := ParsePipeline(*postFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	// Checked like -state-temp; only the Go API reads zero as 1
+	if !(*temp > 0) {
+		fmt.Fprintf(os.Stderr, "Error: invalid temperature %v (must be positive)\n", *temp)
+		os.Exit(1)
+	}
+
+	// A preset supplies defaults for every flag the user did not set
+	exact := false
+	if *presetName != "" {
+		preset, err := LookupPreset(*presetName)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		set := make(map[string]bool)
+		flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+		if !set["k"] {
+			*k = preset.Order
+		}
+		if !set["l"] {
+			*l = preset.MaxLength
+		}
+		if !set["min"] {
+			*minLen = preset.MinLength
+		}
+		if !set["stop"] {
+			stopChars = preset.Stop
+		}
+		if !set["post"] {
+			post = preset.Post
+		}
+		exact = preset.ExactLength
+	}
+	opts := GenerateOptions{
+		Length:      *l,
+		Seed:        *seedFlag,
+		Starter:     *starter,
+		MinLength:   *minLen,
+		Stop:        stopChars,
+		MaxRepeat:   *maxRepeat,
+		Temperature: *temp,
+	}
+	if len(stateTemps) > 0 {
+		opts.StateTemperature = SuffixTemperatures(stateTemps)
+	}
+	smoothing := smoothingFromFlags(*addK, *alpha, unescapeFlag(*alphabet))
+	if _, ok := smoothing.(Dirichlet); ok {
+		opts.Smoothing = smoothing
+	}
+	if *presetName != "" {
+		opts.StartAfter = presets[*presetName].StartAfter
+	}
+
+	// At most one place to take a ready-made chain from
+	sources := 0
+	for _, src := range []string{*modelRef, *replayLog, *snapshotName} {
+		if src != "" {
+			sources++
+		}
+	}
+	if sources > 0 && *cvFolds > 0 {
+		fmt.Fprintf(os.Stderr, "Error: -cv trains its own models and cannot be combined with -model, -replay or -snapshot\n")
+		os.Exit(1)
+	}
+	if sources > 1 {
+		fmt.Fprintf(os.Stderr, "Error: -model, -replay and -snapshot cannot be combined\n")
+		os.Exit(1)
+	}
+
+	// A published model skips reading and training altogether
+	if *modelRef != "" {
+		mc, _, err := NewRegistry(*registryDir).Load(*modelRef)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading model: %v\n", err)
+			os.Exit(1)
+		}
+		mc.PruneTopN(*topN)
+		warnDiversity(mc)
+		generate(mc, opts, post, exact, *printSeed)
+		return
+	}
+
+	// So does a snapshot
+	if *snapshotName != "" {
+		mc, err := LoadSnapshot(*snapshotDir, *snapshotName)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading snapshot: %v\n", err)
+			os.Exit(1)
+		}
+		mc.PruneTopN(*topN)
+		warnDiversity(mc)
+		generate(mc, opts, post, exact, *printSeed)
+		return
+	}
+
+	// And a training log, which is replayed instead
+	if *replayLog != "" {
+		f, err := os.Open(*replayLog)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error opening training log: %v\n", err)
+			os.Exit(1)
+		}
+		mc := NewMarkovChain(*k)
+		err = mc.ApplyLog(f)
+		f.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error replaying training log: %v\n", err)
+			os.Exit(1)
+		}
+		mc.PruneTopN(*topN)
+		warnDiversity(mc)
+		generate(mc, opts, post, exact, *printSeed)
+		return
+	}
+
+	// Read the input text from file or stdin
+	text, err := readInput(*inputFile)
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error reading input: %v\n", err)
 		os.Exit(1)
 	}
 
-	text := builder.String()
+	// Cross-validation replaces generation entirely. It trains on plain
+	// text, so boundary mode only cleans up here.
+	if *cvFolds > 0 {
+		text = mode.Clean(text)
+		result, err := CrossValidate(text, *k, *cvFolds, smoothing)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error cross-validating: %v\n", err)
+			os.Exit(1)
+		}
+		for i, p := range result.Perplexities {
+			fmt.Printf("fold %d: %.3f\n", i+1, p)
+		}
+		fmt.Printf("mean: %.3f\nvariance: %.3f\n", result.Mean, result.Variance)
+		return
+	}
 
-	// Build the Markov Chain
+	// Build the Markov Chain, logging the changes if asked
 	mc := NewMarkovChain(*k)
-	mc.AddText(text)
+	if *trainLog != "" {
+		log, f, err := openTrainingLog(*trainLog)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error opening training log: %v\n", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		mc.SetLog(log)
+	}
+	mc.AddTextNewlines(text, mode)
+	mc.PruneTopN(*topN)
+	if mc.log != nil && mc.log.Err() != nil {
+		fmt.Fprintf(os.Stderr, "Error writing training log: %v\n", mc.log.Err())
+		os.Exit(1)
+	}
+	warnDiversity(mc)
+
+	generate(mc, opts, post, exact, *printSeed)
+}
+
+// generate prints one generation from mc, cleaned up by the post
+// pipeline, and reports the seed used to stderr when asked. With exact,
+// the cleaned output is held to opts.Length (see generateExact).
+func generate(mc *MarkovChain, opts GenerateOptions, post Pipeline, exact, printSeed bool) {
+	// Settle the seed up front so it can be reported
+	opts.Seed = ResolveSeed(opts.Seed)
+	if printSeed {
+		fmt.Fprintf(os.Stderr, "seed: %d\n", opts.Seed)
+	}
 
 	// Generate the output
-	output := mc.Generate(*l, *seedFlag, *starter)
+	var output string
+	if exact {
+		output = generateExact(mc, opts, post)
+	} else {
+		output = post.Apply(mc.GenerateWith(opts))
+	}
 	fmt.Println(output)
 }
+
+// generateExact generates until the post pipeline keeps at least
+// opts.Length characters, doubling the raw length each try, and cuts the
+// cleaned text to exactly that length. The same seed replays the same
+// draws at every length, so the result still depends only on the seed. It
+// gives up, returning what it has, when generation ends early or the
+// pipeline keeps too little of a long enough run.
+func generateExact(mc *MarkovChain, opts GenerateOptions, post Pipeline) string {
+	length := opts.Length
+	if length <= 0 {
+		return ""
+	}
+	for n := length; ; n *= 2 {
+		opts.Length = n
+		raw := mc.GenerateWith(opts)
+		output := []rune(post.Apply(raw))
+		if len(output) >= length {
+			return string(output[:length])
+		}
+		if len([]rune(raw)) < n || n >= 64*length {
+			return string(output)
+		}
+	}
+}
+
+// smoothingFromFlags picks Dirichlet smoothing when a positive alpha is
+// given, and additive smoothing otherwise.
+func smoothingFromFlags(addK, alpha float64, alphabet string) Smoothing {
+	if alpha > 0 {
+		return Dirichlet{Alpha: alpha, Alphabet: alphabet}
+	}
+	return AddK(addK)
+}
+
+// unescapeFlag turns the escapes \n, \t, \r and \\ in a flag value into the
+// characters they stand for, since those are awkward to type in a shell.
+func unescapeFlag(s string) string {
+	return strings.NewReplacer(`\\`, `\`, `\n`, "\n", `\t`, "\t", `\r`, "\r").Replace(s)
+}
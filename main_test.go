@@ -0,0 +1,35 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGenerateWithMaxRepeatKeepsLength(t *testing.T) {
+	mc := NewMarkovChain(2)
+	mc.AddText("book keeper committee coffee\n")
+
+	for seed := int64(0); seed < 50; seed++ {
+		out := mc.GenerateWith(GenerateOptions{Length: 60, Seed: seed, MaxRepeat: 1})
+		if len(out) != 60 {
+			t.Errorf("seed %d: got %d characters, want 60: %q", seed, len(out), out)
+		}
+	}
+}
+
+func TestGenerateWithMaxRepeatCapsRuns(t *testing.T) {
+	// Every state here has a successor other than the repeated one, so the
+	// cap always holds
+	mc := NewMarkovChain(1)
+	mc.AddText("aaaaaaaaaabababab")
+
+	for seed := int64(0); seed < 50; seed++ {
+		out := mc.GenerateWith(GenerateOptions{Length: 100, Seed: seed, MaxRepeat: 2})
+		if len(out) != 100 {
+			t.Errorf("seed %d: got %d characters, want 100", seed, len(out))
+		}
+		if strings.Contains(out, "aaa") {
+			t.Errorf("seed %d: run longer than the cap in %q", seed, out)
+		}
+	}
+}
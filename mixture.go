@@ -0,0 +1,321 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"text/tabwriter"
+)
+
+// Mixture blends several chains, usually of different orders, by linear
+// interpolation: the probability of the next character is the weighted
+// sum of what each chain predicts from its own last 'order' characters.
+type Mixture struct {
+	Chains []*MarkovChain
+	// Weights holds one non-negative weight per chain, summing to 1.
+	Weights []float64
+}
+
+// maxOrder returns the largest order among the chains.
+func maxOrder(chains []*MarkovChain) int {
+	order := 0
+	for _, mc := range chains {
+		if mc.order > order {
+			order = mc.order
+		}
+	}
+	return order
+}
+
+// componentProbs scores text with every chain separately. Row i holds the
+// smoothed probability chain i gives each character of text that has
+// enough context for the highest-order chain, so all rows line up. Rows
+// are empty when text is too short for that order.
+func componentProbs(chains []*MarkovChain, text string, s Smoothing) [][]float64 {
+	start := maxOrder(chains)
+	scored := 0
+	if len(text) > start {
+		scored = len(text) - start
+	}
+	probs := make([][]float64, len(chains))
+	for i, mc := range chains {
+		sc := mc.newScorer(s)
+		row := make([]float64, 0, scored)
+		for t := start; t < len(text); t++ {
+			row = append(row, sc.prob(text[t-mc.order:t], rune(text[t])))
+		}
+		probs[i] = row
+	}
+	return probs
+}
+
+// mixturePerplexity turns per-chain probabilities and weights into the
+// perplexity of the blend.
+func mixturePerplexity(probs [][]float64, weights []float64) float64 {
+	if len(probs) == 0 || len(probs[0]) == 0 {
+		return math.NaN()
+	}
+	bits := 0.0
+	for t := range probs[0] {
+		p := 0.0
+		for i := range probs {
+			p += weights[i] * probs[i][t]
+		}
+		bits -= math.Log2(p)
+	}
+	return math.Exp2(bits / float64(len(probs[0])))
+}
+
+// Perplexity returns the per-character perplexity of text under the
+// mixture, each chain smoothed by s. Scoring starts once there is enough
+// context for the highest-order chain; it returns NaN if that leaves
+// nothing to score.
+func (m *Mixture) Perplexity(text string, s Smoothing) float64 {
+	return mixturePerplexity(componentProbs(m.Chains, text, s), m.Weights)
+}
+
+// top returns the highest-order chain, whose states the mixture walks.
+func (m *Mixture) top() *MarkovChain {
+	best := m.Chains[0]
+	for _, mc := range m.Chains[1:] {
+		if mc.order > best.order {
+			best = mc
+		}
+	}
+	return best
+}
+
+// distribution blends what every chain offers after state, a context of
+// the highest order's length: each chain's own distribution, normalized and
+// scaled by the chain's weight. Chains that offer nothing drop out, so the
+// others share their weight. Weights come back non-nil.
+func (m *Mixture) distribution(state string, excluded func(rune) bool, s Smoothing, supports [][]rune, vocabs []int) (runes []rune, weights []float64) {
+	index := make(map[rune]int)
+	for i, mc := range m.Chains {
+		if m.Weights[i] <= 0 {
+			continue
+		}
+		rs, ws := mc.distribution(state[len(state)-mc.order:], excluded, s, supports[i], vocabs[i])
+		if len(rs) == 0 {
+			continue
+		}
+		total := float64(len(rs))
+		if ws != nil {
+			total = 0
+			for _, w := range ws {
+				total += w
+			}
+		}
+		for j, r := range rs {
+			w := 1.0
+			if ws != nil {
+				w = ws[j]
+			}
+			k, ok := index[r]
+			if !ok {
+				k = len(runes)
+				index[r] = k
+				runes = append(runes, r)
+				weights = append(weights, 0)
+			}
+			weights[k] += m.Weights[i] * w / total
+		}
+	}
+	return runes, weights
+}
+
+// walkOrder implements walker: the mixture walks the states of its
+// highest-order chain.
+func (m *Mixture) walkOrder() int {
+	return m.top().order
+}
+
+// trained implements walker.
+func (m *Mixture) trained() bool {
+	return m.top().trained()
+}
+
+// known implements walker: a state is known if any weighted chain has
+// seen its part of it in training.
+func (m *Mixture) known(state string) bool {
+	for i, mc := range m.Chains {
+		if m.Weights[i] > 0 && mc.known(state[len(state)-mc.order:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// sortedStates implements walker.
+func (m *Mixture) sortedStates() []string {
+	return m.top().sortedStates()
+}
+
+// startStates implements walker.
+func (m *Mixture) startStates(after string) []string {
+	return m.top().startStates(after)
+}
+
+// sampler implements walker. Each chain smooths over its own support.
+func (m *Mixture) sampler(s Smoothing) func(state string, excluded func(rune) bool) ([]rune, []float64) {
+	supports := make([][]rune, len(m.Chains))
+	vocabs := make([]int, len(m.Chains))
+	if s != nil {
+		for i, mc := range m.Chains {
+			supports[i], vocabs[i] = mc.support(s)
+		}
+	}
+	return func(state string, excluded func(rune) bool) ([]rune, []float64) {
+		return m.distribution(state, excluded, s, supports, vocabs)
+	}
+}
+
+// nextState implements walker. States of a top order of zero stay empty.
+func (m *Mixture) nextState(state string, nextChar rune) string {
+	if top := m.top(); top.order > 0 {
+		return top.nextState(state, nextChar)
+	}
+	return state
+}
+
+// GenerateWith produces text from the blend, drawing every character from
+// the weighted mix of what each chain predicts from its own last 'order'
+// characters. It honours every GenerateOptions field the way
+// MarkovChain.GenerateWith does; states (for StartAfter, StateTemperature
+// and dead ends) are those of the highest-order chain.
+func (m *Mixture) GenerateWith(opts GenerateOptions) string {
+	return walk(m, opts)
+}
+
+// FitMixtureWeights learns the interpolation weights that minimize the
+// perplexity of validation, using expectation-maximization. Each round
+// gives every chain the average share of the blended probability it was
+// responsible for, which never makes the fit worse. Rounds stop once
+// perplexity improves by less than a millionth, or after maxIter rounds.
+func FitMixtureWeights(chains []*MarkovChain, validation string, s Smoothing, maxIter int) (*Mixture, error) {
+	if len(chains) == 0 {
+		return nil, fmt.Errorf("no chains to blend")
+	}
+	if len(validation) <= maxOrder(chains) {
+		return nil, fmt.Errorf("validation text too short for order %d", maxOrder(chains))
+	}
+
+	probs := componentProbs(chains, validation, s)
+	n := len(probs[0])
+
+	// Start from equal weights
+	weights := make([]float64, len(chains))
+	for i := range weights {
+		weights[i] = 1 / float64(len(chains))
+	}
+
+	prev := mixturePerplexity(probs, weights)
+	for iter := 0; iter < maxIter; iter++ {
+		// E-step: how much of each character's probability each chain
+		// supplied. A character no chain can produce says nothing about
+		// the weights, so it is left out.
+		shares := make([]float64, len(chains))
+		scored := 0
+		for t := 0; t < n; t++ {
+			p := 0.0
+			for i := range chains {
+				p += weights[i] * probs[i][t]
+			}
+			if p == 0 {
+				continue
+			}
+			scored++
+			for i := range chains {
+				shares[i] += weights[i] * probs[i][t] / p
+			}
+		}
+		if scored == 0 {
+			break
+		}
+
+		// M-step: the new weights are the average shares over the scored
+		// characters, which sum to 1
+		for i := range weights {
+			weights[i] = shares[i] / float64(scored)
+		}
+
+		ppl := mixturePerplexity(probs, weights)
+		if prev-ppl < 1e-6*prev {
+			break
+		}
+		prev = ppl
+	}
+
+	return &Mixture{Chains: chains, Weights: weights}, nil
+}
+
+// runBlend implements the "blend" subcommand: train one chain per order,
+// fit their interpolation weights on a held-out validation split, and
+// report the weights alongside each chain's own perplexity, and optionally
+// a sample generated from the blend.
+func runBlend(args []string) {
+	fs := flag.NewFlagSet("blend", flag.ExitOnError)
+	inputFile := fs.String("i", "", "Input file (optional, reads from stdin if not provided)")
+	ordersFlag := fs.String("orders", "1..4", "Orders to blend, e.g. 1..4 or 1,3,5")
+	holdout := fs.Float64("holdout", 0.1, "Fraction of the corpus (taken from the end) used to fit the weights")
+	addK := fs.Float64("addk", 1, "Additive smoothing used when scoring unseen transitions")
+	alpha := fs.Float64("alpha", 0, "Dirichlet prior concentration used for scoring instead of -addk")
+	alphabet := fs.String("alphabet", "", `Characters the Dirichlet prior ranges over on top of the training alphabet (accepts \n, \t, \r)`)
+	iterations := fs.Int("iter", 100, "Maximum number of EM rounds")
+	l := fs.Int("l", 0, "Length of a sample generated from the blend (0 for none)")
+	seedFlag := fs.Int64("seed", -1, "Random seed for the sample")
+	newlines := fs.String("newlines", "lf", "Newline handling for training text: preserve, lf, normalize or boundary")
+	fs.Parse(args)
+
+	mode, err := ParseNewlineMode(*newlines)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	orders, err := parseOrders(*ordersFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error parsing -orders: %v\n", err)
+		os.Exit(1)
+	}
+
+	text, err := readInput(*inputFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading input: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Score on text cleaned up the way the chain is trained
+	text = mode.Clean(text)
+	train, validation := SplitHoldout(text, *holdout)
+
+	chains := make([]*MarkovChain, len(orders))
+	for i, k := range orders {
+		chains[i] = NewMarkovChain(k)
+		chains[i].AddTextNewlines(train, mode)
+	}
+
+	smoothing := smoothingFromFlags(*addK, *alpha, unescapeFlag(*alphabet))
+	mix, err := FitMixtureWeights(chains, validation, smoothing, *iterations)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error fitting weights: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Each chain alone, scored over the same positions as the blend
+	probs := componentProbs(chains, validation, smoothing)
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "order\tweight\tperplexity")
+	for i, k := range orders {
+		alone := make([]float64, len(chains))
+		alone[i] = 1
+		fmt.Fprintf(w, "%d\t%.4f\t%.3f\n", k, mix.Weights[i], mixturePerplexity(probs, alone))
+	}
+	fmt.Fprintf(w, "blend\t\t%.3f\n", mixturePerplexity(probs, mix.Weights))
+	w.Flush()
+
+	if *l > 0 {
+		fmt.Printf("\n%s\n", mix.GenerateWith(GenerateOptions{Length: *l, Seed: *seedFlag}))
+	}
+}
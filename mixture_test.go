@@ -0,0 +1,76 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+// mixtureCorpus is varied enough that no single order wins everywhere.
+const mixtureCorpus = "the cat sat on the mat. the dog sat on the log. a cat and a dog met on a mat by a log. " +
+	"then the cat ran off the mat and the dog ran after the cat. the end of the tale of the cat and the dog. "
+
+// trainOrders trains one chain per order on text.
+func trainOrders(text string, orders ...int) []*MarkovChain {
+	chains := make([]*MarkovChain, len(orders))
+	for i, k := range orders {
+		chains[i] = NewMarkovChain(k)
+		chains[i].AddText(text)
+	}
+	return chains
+}
+
+func TestFitMixtureWeightsNeverWorsens(t *testing.T) {
+	train, validation := SplitHoldout(strings.Repeat(mixtureCorpus, 3), 0.2)
+	chains := trainOrders(train, 0, 1, 2, 3)
+
+	for _, s := range []Smoothing{AddK(1), AddK(0.1), AddK(0), Dirichlet{Alpha: 0.5}} {
+		prev := math.Inf(1)
+		for iter := 0; iter <= 20; iter++ {
+			mix, err := FitMixtureWeights(chains, validation, s, iter)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			sum := 0.0
+			for _, w := range mix.Weights {
+				if w < 0 {
+					t.Fatalf("%v, %d rounds: negative weight in %v", s, iter, mix.Weights)
+				}
+				sum += w
+			}
+			if math.Abs(sum-1) > 1e-9 {
+				t.Fatalf("%v, %d rounds: weights %v sum to %v", s, iter, mix.Weights, sum)
+			}
+
+			ppl := mix.Perplexity(validation, s)
+			if ppl > prev*(1+1e-9) {
+				t.Fatalf("%v: perplexity rose from %v to %v after %d rounds", s, prev, ppl, iter)
+			}
+			prev = ppl
+		}
+	}
+}
+
+func TestMixturePerplexityShortText(t *testing.T) {
+	mix := &Mixture{Chains: trainOrders(mixtureCorpus, 1, 3), Weights: []float64{0.5, 0.5}}
+	for _, text := range []string{"", "ab", "abc"} {
+		if p := mix.Perplexity(text, AddK(1)); !math.IsNaN(p) {
+			t.Errorf("Perplexity(%q) = %v, want NaN", text, p)
+		}
+	}
+}
+
+func TestMixtureGenerateWith(t *testing.T) {
+	mix := &Mixture{Chains: trainOrders(mixtureCorpus, 1, 2, 4), Weights: []float64{0.2, 0.3, 0.5}}
+	for seed := int64(0); seed < 20; seed++ {
+		opts := GenerateOptions{Length: 80, Seed: seed, Starter: "the "}
+		out := mix.GenerateWith(opts)
+		if len(out) != 80 || !strings.HasPrefix(out, "the ") {
+			t.Errorf("seed %d: got %q", seed, out)
+		}
+		if again := mix.GenerateWith(opts); again != out {
+			t.Errorf("seed %d: not reproducible: %q then %q", seed, out, again)
+		}
+	}
+}
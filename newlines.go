@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// NewlineMode says how line endings and other layout whitespace in the
+// training text are handled.
+type NewlineMode string
+
+const (
+	// NewlinesPreserve trains on the text byte for byte, so CRLF line
+	// endings put '\r' into states and output.
+	NewlinesPreserve NewlineMode = "preserve"
+	// NewlinesLF turns CRLF and lone CR into LF and leaves everything else
+	// alone, so text that already uses LF trains byte for byte.
+	NewlinesLF NewlineMode = "lf"
+	// NewlinesNormalize turns CRLF and lone CR into LF, tabs into spaces,
+	// and runs of blank lines into a single blank line.
+	NewlinesNormalize NewlineMode = "normalize"
+	// NewlinesBoundary normalizes, then trains on every non-blank line as
+	// its own sequence, so no transition spans two lines. Newline becomes a
+	// boundary token: each line is trained as if it sat between two runs of
+	// newlines, so the chain learns how lines start and end, and the end of
+	// a line leads back into the start of another instead of a dead end.
+	NewlinesBoundary NewlineMode = "boundary"
+)
+
+// ParseNewlineMode checks that s names a newline mode.
+func ParseNewlineMode(s string) (NewlineMode, error) {
+	switch mode := NewlineMode(s); mode {
+	case NewlinesPreserve, NewlinesLF, NewlinesNormalize, NewlinesBoundary:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown newline mode %q (available: preserve, lf, normalize, boundary)", s)
+}
+
+// Clean returns text with the mode's clean-up applied but without boundary
+// training, so held-out text can be scored the way the chain was trained.
+func (mode NewlineMode) Clean(text string) string {
+	switch mode {
+	case NewlinesLF:
+		return NormalizeLineEndings(text)
+	case NewlinesNormalize, NewlinesBoundary:
+		return NormalizeText(text)
+	}
+	return text
+}
+
+// NormalizeLineEndings turns CRLF and lone CR line endings into LF.
+func NormalizeLineEndings(text string) string {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	return strings.ReplaceAll(text, "\r", "\n")
+}
+
+// NormalizeText turns CRLF and lone CR line endings into LF, tabs into
+// single spaces, and any run of blank (or whitespace-only) lines into a
+// single empty line.
+func NormalizeText(text string) string {
+	text = NormalizeLineEndings(text)
+	text = strings.ReplaceAll(text, "\t", " ")
+
+	lines := strings.Split(text, "\n")
+	kept := lines[:0]
+	prevBlank := false
+	for _, line := range lines {
+		blank := strings.TrimSpace(line) == ""
+		if blank {
+			if prevBlank {
+				continue
+			}
+			line = ""
+		}
+		kept = append(kept, line)
+		prevBlank = blank
+	}
+	return strings.Join(kept, "\n")
+}
+
+// AddTextNewlines trains the chain on text after handling its newlines
+// according to mode.
+func (mc *MarkovChain) AddTextNewlines(text string, mode NewlineMode) {
+	switch mode {
+	case NewlinesLF:
+		mc.AddText(NormalizeLineEndings(text))
+	case NewlinesNormalize:
+		mc.AddText(NormalizeText(text))
+	case NewlinesBoundary:
+		// Pad each line on both sides with enough newlines to fill a whole
+		// state, so every line ends in the state every line starts from
+		pad := strings.Repeat("\n", mc.order)
+		for _, line := range strings.Split(NormalizeText(text), "\n") {
+			if line != "" {
+				mc.AddText(pad + line + pad)
+			}
+		}
+	default:
+		mc.AddText(text)
+	}
+}
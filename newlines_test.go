@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// boundaryNames share no state of order 3 that leads to different
+// characters, so a chain trained on them can only reproduce them.
+var boundaryNames = []string{"alice", "bob", "carol", "dave", "erin", "frank", "heidi", "ivan", "judy", "mallory", "peggy", "trent", "victor", "walter"}
+
+func TestBoundaryModeKeepsLinesWhole(t *testing.T) {
+	mc := NewMarkovChain(3)
+	mc.AddTextNewlines(strings.Join(boundaryNames, "\r\n")+"\r\n", NewlinesBoundary)
+
+	// Check the premise: only the all-newline state has a choice
+	for state, freq := range mc.counts() {
+		if len(freq) > 1 && state != "\n\n\n" {
+			t.Fatalf("state %q has %d successors", state, len(freq))
+		}
+	}
+
+	for seed := int64(0); seed < 20; seed++ {
+		out := mc.GenerateWith(GenerateOptions{Length: 200, Seed: seed})
+		if len(out) != 200 {
+			t.Fatalf("seed %d: got %d characters", seed, len(out))
+		}
+		pieces := strings.FieldsFunc(out, func(r rune) bool { return r == '\n' })
+		for i, piece := range pieces {
+			found := false
+			for _, name := range boundaryNames {
+				// The first piece may start mid-line and the last may be
+				// cut short; everything in between is a whole line
+				switch {
+				case i == 0 && strings.HasSuffix(name, piece),
+					i == len(pieces)-1 && strings.HasPrefix(name, piece),
+					piece == name:
+					found = true
+				}
+			}
+			if !found {
+				t.Errorf("seed %d: piece %q of %q is not from a corpus line", seed, piece, out)
+			}
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// PostStep is one stage of an output clean-up pipeline. Any function from
+// string to string can be used, so callers can mix their own steps in with
+// the built-in ones.
+type PostStep func(string) string
+
+// Pipeline is a sequence of post-processing steps applied in order.
+type Pipeline []PostStep
+
+// Apply runs s through every step of the pipeline.
+func (p Pipeline) Apply(s string) string {
+	for _, step := range p {
+		s = step(s)
+	}
+	return s
+}
+
+// postSteps holds the built-in steps by the names ParsePipeline accepts.
+var postSteps = map[string]PostStep{
+	"capitalize":    CapitalizeSentences,
+	"collapse":      CollapseWhitespace,
+	"quotes":        NormalizeQuotes,
+	"trim-sentence": TrimToLastSentence,
+	"trim":          strings.TrimSpace,
+	"alnum":         AlphanumericOnly,
+}
+
+// PostStepNames lists the built-in steps in alphabetical order.
+func PostStepNames() []string {
+	names := make([]string, 0, len(postSteps))
+	for name := range postSteps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ParsePipeline builds a pipeline from a comma-separated list of built-in
+// step names, such as "quotes,collapse,capitalize".
+func ParsePipeline(spec string) (Pipeline, error) {
+	var p Pipeline
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		step, ok := postSteps[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown post-processing step %q (available: %s)", name, strings.Join(PostStepNames(), ", "))
+		}
+		p = append(p, step)
+	}
+	return p, nil
+}
+
+// isSentenceEnd reports whether r ends a sentence.
+func isSentenceEnd(r rune) bool {
+	return r == '.' || r == '!' || r == '?'
+}
+
+// CapitalizeSentences upper-cases the first letter of the text and the
+// first letter following every sentence-ending punctuation mark.
+func CapitalizeSentences(s string) string {
+	var b strings.Builder
+	capNext := true
+	for _, r := range s {
+		switch {
+		case capNext && unicode.IsLetter(r):
+			r = unicode.ToUpper(r)
+			capNext = false
+		case isSentenceEnd(r):
+			capNext = true
+		case capNext && !unicode.IsSpace(r) && !unicode.IsPunct(r):
+			// A digit or symbol starts the sentence; leave it alone
+			capNext = false
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// CollapseWhitespace replaces every run of whitespace, newlines included,
+// with a single space and trims both ends.
+func CollapseWhitespace(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// quoteReplacer maps typographic quotes onto their plain ASCII forms.
+var quoteReplacer = strings.NewReplacer(
+	"“", `"`, "”", `"`, "„", `"`, "‟", `"`, "«", `"`, "»", `"`,
+	"‘", "'", "’", "'", "‚", "'", "‛", "'", "‹", "'", "›", "'",
+)
+
+// NormalizeQuotes turns curly and angled quotation marks into straight
+// ASCII quotes.
+func NormalizeQuotes(s string) string {
+	return quoteReplacer.Replace(s)
+}
+
+// TrimToLastSentence cuts s just after its last sentence-ending
+// punctuation mark, keeping any closing quotes or brackets that directly
+// follow it. Text with no sentence end is returned unchanged.
+func TrimToLastSentence(s string) string {
+	end := strings.LastIndexFunc(s, isSentenceEnd)
+	if end < 0 {
+		return s
+	}
+	end++
+	for end < len(s) {
+		r, size := utf8.DecodeRuneInString(s[end:])
+		if !strings.ContainsRune(`"')]`+"”’", r) {
+			break
+		}
+		end += size
+	}
+	return s[:end]
+}
+
+// AlphanumericOnly drops every character that is neither a letter nor a
+// digit.
+func AlphanumericOnly(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return r
+		}
+		return -1
+	}, s)
+}
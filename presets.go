@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Preset bundles the settings that suit one kind of output, so casual users
+// can pick a preset instead of tuning every flag. Presets are all
+// character-level, since that is the only tokenizer the chain has.
+type Preset struct {
+	Name        string
+	Description string
+	// Order is the chain order to train with.
+	Order int
+	// MinLength and MaxLength bound the generated length (see
+	// GenerateOptions.MinLength and GenerateOptions.Length).
+	MinLength int
+	MaxLength int
+	// Stop lists the characters that end the output once MinLength is met.
+	Stop string
+	// StartAfter limits where output may begin (see GenerateOptions.StartAfter).
+	StartAfter string
+	// Post cleans up the raw generated text.
+	Post Pipeline
+	// ExactLength makes the output exactly MaxLength characters after Post,
+	// generating more when Post removes characters and cutting the cleaned
+	// text back to length.
+	ExactLength bool
+}
+
+// presets holds the built-in presets, keyed by name.
+var presets = map[string]Preset{
+	"names": {
+		Name:        "names",
+		Description: "single names from a one-name-per-line corpus",
+		Order:       3,
+		MinLength:   5, // four letters plus the newline
+		MaxLength:   13,
+		Stop:        "\n",
+		StartAfter:  "\n",
+		Post:        Pipeline{strings.TrimSpace, CapitalizeSentences},
+	},
+	"lorem": {
+		Name:        "lorem",
+		Description: "a paragraph of filler prose ending on a full sentence",
+		Order:       4,
+		MinLength:   200,
+		MaxLength:   600,
+		Stop:        ".",
+		StartAfter:  ". ",
+		Post:        Pipeline{CollapseWhitespace, CapitalizeSentences},
+	},
+	"passwords": {
+		Name:        "passwords",
+		Description: "pronounceable passwords (not cryptographically random)",
+		Order:       2,
+		MinLength:   16,
+		MaxLength:   16,
+		Post:        Pipeline{AlphanumericOnly},
+		ExactLength: true,
+	},
+	"tweets": {
+		Name:        "tweets",
+		Description: "short posts of at most 280 characters ending on a sentence or line",
+		Order:       5,
+		MinLength:   60,
+		MaxLength:   280,
+		Stop:        ".!?\n",
+		StartAfter:  " \n",
+		Post:        Pipeline{CollapseWhitespace},
+	},
+}
+
+// LookupPreset returns the built-in preset with the given name.
+func LookupPreset(name string) (Preset, error) {
+	p, ok := presets[name]
+	if !ok {
+		return Preset{}, fmt.Errorf("unknown preset %q (available: %s)", name, strings.Join(PresetNames(), ", "))
+	}
+	return p, nil
+}
+
+// PresetNames lists the built-in presets in alphabetical order.
+func PresetNames() []string {
+	names := make([]string, 0, len(presets))
+	for name := range presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,109 @@
+package main
+
+import "sort"
+
+// PruneTopN keeps only the n most frequent next characters of every state
+// and drops the rest, breaking ties in favour of the lower character. The
+// kept characters keep their counts, so their probabilities are simply
+// renormalized among themselves. Every state is then stored compactly, as
+// at most n distinct characters with a count each instead of one entry per
+// occurrence, so a state's memory no longer grows with the corpus; later
+// training of a pruned state updates its counts. Sampling from a pruned
+// state is a weighted draw over those n characters. It returns how many
+// observed transitions were removed. An n below 1 leaves the chain
+// untouched.
+func (mc *MarkovChain) PruneTopN(n int) int {
+	if n < 1 {
+		return 0
+	}
+	if mc.pruned == nil {
+		mc.pruned = make(map[string][]int)
+	}
+	removed := 0
+	var deltas map[string]map[rune]int
+	if mc.log != nil {
+		deltas = make(map[string]map[rune]int)
+	}
+	for state, freq := range mc.counts() {
+		// Rank the successors, most frequent first
+		ranked := make([]rune, 0, len(freq))
+		for r := range freq {
+			ranked = append(ranked, r)
+		}
+		sort.Slice(ranked, func(i, j int) bool {
+			if freq[ranked[i]] != freq[ranked[j]] {
+				return freq[ranked[i]] > freq[ranked[j]]
+			}
+			return ranked[i] < ranked[j]
+		})
+		dropped := ranked[min(n, len(ranked)):]
+		ranked = ranked[:len(ranked)-len(dropped)]
+
+		// Store the survivors once each, with their counts
+		kept := make([]rune, len(ranked))
+		counts := make([]int, len(ranked))
+		copy(kept, ranked)
+		for i, r := range kept {
+			counts[i] = freq[r]
+		}
+		mc.transitions[state] = kept
+		mc.pruned[state] = counts
+
+		// Log what was dropped
+		if len(dropped) == 0 {
+			continue
+		}
+		if deltas != nil {
+			deltas[state] = make(map[rune]int)
+		}
+		for _, r := range dropped {
+			removed += freq[r]
+			if deltas != nil {
+				deltas[state][r] = -freq[r]
+			}
+		}
+	}
+	if deltas != nil {
+		mc.log.Record(deltas)
+	}
+	return removed
+}
+
+// adjustPruned is adjust for a pruned state, changing the count of next
+// instead of adding or removing list entries.
+func (mc *MarkovChain) adjustPruned(state string, next rune, delta int) int {
+	if delta == 0 {
+		return 0
+	}
+	nextRunes, counts := mc.transitions[state], mc.pruned[state]
+	i := 0
+	for i < len(nextRunes) && nextRunes[i] != next {
+		i++
+	}
+	if delta >= 0 {
+		if i == len(nextRunes) {
+			mc.transitions[state] = append(nextRunes, next)
+			mc.pruned[state] = append(counts, delta)
+		} else {
+			counts[i] += delta
+		}
+		return delta
+	}
+
+	if i == len(nextRunes) {
+		return 0
+	}
+	removed := min(-delta, counts[i])
+	counts[i] -= removed
+	if counts[i] == 0 {
+		nextRunes = append(nextRunes[:i], nextRunes[i+1:]...)
+		counts = append(counts[:i], counts[i+1:]...)
+	}
+	if len(nextRunes) == 0 {
+		delete(mc.transitions, state)
+		delete(mc.pruned, state)
+	} else {
+		mc.transitions[state], mc.pruned[state] = nextRunes, counts
+	}
+	return -removed
+}
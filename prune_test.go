@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// topN returns freq limited to its n most frequent characters, ties going
+// to the lower character, as PruneTopN keeps them.
+func topN(freq map[rune]int, n int) map[rune]int {
+	kept := make(map[rune]int)
+	for len(kept) < n && len(kept) < len(freq) {
+		var best rune = -1
+		for r, c := range freq {
+			if _, done := kept[r]; done {
+				continue
+			}
+			if best < 0 || c > freq[best] || (c == freq[best] && r < best) {
+				best = r
+			}
+		}
+		kept[best] = freq[best]
+	}
+	return kept
+}
+
+func TestPruneTopNBoundsStates(t *testing.T) {
+	text := strings.Repeat("the cat sat on the mat; then the rat ate the hat! ", 50)
+	mc := NewMarkovChain(1)
+	mc.AddText(text)
+	before := mc.counts()
+	_, total := mc.Size()
+
+	removed := mc.PruneTopN(2)
+
+	// Every state stores at most two entries, however often it was seen
+	for state, nextRunes := range mc.transitions {
+		if len(nextRunes) > 2 {
+			t.Errorf("state %q stores %d entries", state, len(nextRunes))
+		}
+	}
+
+	// The kept characters keep their counts
+	want := make(map[string]map[rune]int)
+	kept := 0
+	for state, freq := range before {
+		want[state] = topN(freq, 2)
+		for _, c := range want[state] {
+			kept += c
+		}
+	}
+	if got := mc.counts(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("counts after pruning: %v, want %v", got, want)
+	}
+	if removed != total-kept {
+		t.Errorf("removed %d, want %d", removed, total-kept)
+	}
+	if _, n := mc.Size(); n != kept {
+		t.Errorf("Size after pruning: %d transitions, want %d", n, kept)
+	}
+
+	// Training a pruned state updates its counts in place
+	mc.AddText("tht")
+	want["t"]['h'] += 1
+	want["h"]['t'] = 1
+	if got := mc.counts(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("counts after more training: %v, want %v", got, want)
+	}
+
+	// Saving keeps the compact form
+	var buf bytes.Buffer
+	if err := mc.Save(&buf); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadMarkovChain(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded.counts(), want) || !reflect.DeepEqual(loaded.transitions, mc.transitions) {
+		t.Errorf("pruned chain did not survive Save and LoadMarkovChain")
+	}
+}
+
+func TestPruneTopNSamplesKeptCharacters(t *testing.T) {
+	mc := NewMarkovChain(1)
+	mc.AddText(strings.Repeat("ab", 30) + strings.Repeat("ac", 10) + "ad")
+	mc.PruneTopN(2)
+
+	seen := make(map[byte]int)
+	for seed := int64(0); seed < 50; seed++ {
+		out := mc.GenerateWith(GenerateOptions{Length: 200, Seed: seed, Starter: "a"})
+		if len(out) != 200 {
+			t.Fatalf("seed %d: got %d characters", seed, len(out))
+		}
+		for i := 1; i < len(out); i++ {
+			if out[i-1] == 'a' {
+				seen[out[i]]++
+			}
+		}
+	}
+	if seen['d'] > 0 {
+		t.Errorf("a pruned successor was generated %d times", seen['d'])
+	}
+	// 'b' follows 'a' three times as often as 'c'
+	if ratio := float64(seen['b']) / float64(seen['c']); ratio < 2.5 || ratio > 3.5 {
+		t.Errorf("b/c ratio after 'a' is %.2f, want about 3", ratio)
+	}
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Files making up one published version inside the registry:
+//
+//	<root>/<name>/<version>/model.bin
+//	<root>/<name>/<version>/manifest.json
+const (
+	modelFile    = "model.bin"
+	manifestFile = "manifest.json"
+)
+
+// Manifest describes one published model version.
+type Manifest struct {
+	Name        string    `json:"name"`
+	Version     int       `json:"version"`
+	Order       int       `json:"order"`
+	States      int       `json:"states"`
+	Transitions int       `json:"transitions"`
+	Source      string    `json:"source,omitempty"`
+	Published   time.Time `json:"published"`
+	// Warnings records any diversity warnings the model had when it was
+	// published (see CheckDiversity).
+	Warnings []Warning `json:"warnings,omitempty"`
+}
+
+// Ref returns the "name@version" reference for the manifest's model.
+func (m Manifest) Ref() string {
+	return fmt.Sprintf("%s@%d", m.Name, m.Version)
+}
+
+// Registry is a directory of named, versioned models. Versions are
+// numbered from 1 upwards and never reused, so older versions stay
+// loadable for rollback after newer ones are published.
+type Registry struct {
+	Root string
+}
+
+// NewRegistry returns a registry rooted at the given directory. The
+// directory is created on first publish.
+func NewRegistry(root string) *Registry {
+	return &Registry{Root: root}
+}
+
+// validateName rejects names that would escape the registry directory or
+// be ambiguous in a "name@version" reference.
+func validateName(name string) error {
+	// A leading dot would also hide the name from listings, which skip
+	// temporary files
+	if name == "" || strings.HasPrefix(name, ".") || strings.ContainsAny(name, `@/\`) {
+		return fmt.Errorf("invalid model name %q", name)
+	}
+	return nil
+}
+
+// ParseRef splits a model reference into its name and version. The version
+// is "latest" when the reference is a bare name or ends in "@latest".
+func ParseRef(ref string) (name, version string) {
+	if i := strings.LastIndex(ref, "@"); i >= 0 {
+		return ref[:i], ref[i+1:]
+	}
+	return ref, "latest"
+}
+
+// Publish stores mc as the next version of the named model and returns its
+// manifest. Both files are written atomically and the manifest goes last,
+// so a version directory without one is an interrupted publish and is
+// ignored by List and Load.
+func (r *Registry) Publish(name string, mc *MarkovChain, source string) (Manifest, error) {
+	if err := validateName(name); err != nil {
+		return Manifest{}, err
+	}
+	modelDir := filepath.Join(r.Root, name)
+	if err := os.MkdirAll(modelDir, 0o755); err != nil {
+		return Manifest{}, err
+	}
+
+	// Claim the next free version number. Mkdir fails if the directory
+	// exists, so concurrent publishers cannot both take the same version.
+	versions, err := r.versionDirs(name)
+	if err != nil {
+		return Manifest{}, err
+	}
+	version := 1
+	if len(versions) > 0 {
+		version = versions[len(versions)-1] + 1
+	}
+	for {
+		err := os.Mkdir(filepath.Join(modelDir, strconv.Itoa(version)), 0o755)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return Manifest{}, err
+		}
+		version++
+	}
+	dir := filepath.Join(modelDir, strconv.Itoa(version))
+
+	// Model first...
+	if err := writeFileAtomic(filepath.Join(dir, modelFile), mc.Save); err != nil {
+		return Manifest{}, err
+	}
+
+	// ...then the manifest that marks the version as complete
+	states, transitions := mc.Size()
+	manifest := Manifest{
+		Name:        name,
+		Version:     version,
+		Order:       mc.order,
+		States:      states,
+		Transitions: transitions,
+		Source:      source,
+		Published:   time.Now().UTC(),
+		Warnings:    mc.CheckDiversity(DefaultDiversityThresholds),
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return Manifest{}, err
+	}
+	writeManifest := func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(dir, manifestFile), writeManifest); err != nil {
+		return Manifest{}, err
+	}
+
+	return manifest, nil
+}
+
+// versionDirs returns the numeric version directories of a model in
+// ascending order, whether or not they hold a complete version.
+func (r *Registry) versionDirs(name string) ([]int, error) {
+	entries, err := os.ReadDir(filepath.Join(r.Root, name))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var versions []int
+	for _, entry := range entries {
+		if v, err := strconv.Atoi(entry.Name()); err == nil && entry.IsDir() && v > 0 {
+			versions = append(versions, v)
+		}
+	}
+	sort.Ints(versions)
+	return versions, nil
+}
+
+// readManifest loads the manifest of one version.
+func (r *Registry) readManifest(name string, version int) (Manifest, error) {
+	data, err := os.ReadFile(filepath.Join(r.Root, name, strconv.Itoa(version), manifestFile))
+	if err != nil {
+		return Manifest{}, err
+	}
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return Manifest{}, fmt.Errorf("%s@%d: %v", name, version, err)
+	}
+	return manifest, nil
+}
+
+// List returns the manifests of every complete version of the named model,
+// oldest first. With an empty name it lists every model in the registry.
+func (r *Registry) List(name string) ([]Manifest, error) {
+	var names []string
+	if name != "" {
+		if err := validateName(name); err != nil {
+			return nil, err
+		}
+		names = []string{name}
+	} else {
+		entries, err := os.ReadDir(r.Root)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		for _, entry := range entries {
+			if entry.IsDir() {
+				names = append(names, entry.Name())
+			}
+		}
+	}
+
+	var manifests []Manifest
+	for _, n := range names {
+		versions, err := r.versionDirs(n)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range versions {
+			manifest, err := r.readManifest(n, v)
+			if errors.Is(err, os.ErrNotExist) {
+				// Interrupted publish, not a real version
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			manifests = append(manifests, manifest)
+		}
+	}
+	return manifests, nil
+}
+
+// Load reads the model named by ref, which is "name@version",
+// "name@latest" or a bare name (meaning latest).
+func (r *Registry) Load(ref string) (*MarkovChain, Manifest, error) {
+	name, version := ParseRef(ref)
+	// List treats an empty name as "every model", so check it here
+	if err := validateName(name); err != nil {
+		return nil, Manifest{}, err
+	}
+	manifests, err := r.List(name)
+	if err != nil {
+		return nil, Manifest{}, err
+	}
+	if len(manifests) == 0 {
+		return nil, Manifest{}, fmt.Errorf("no published versions of %q in %s", name, r.Root)
+	}
+
+	// Pick the requested version among the complete ones
+	var manifest Manifest
+	if version == "latest" {
+		manifest = manifests[len(manifests)-1]
+	} else {
+		v, err := strconv.Atoi(version)
+		if err != nil {
+			return nil, Manifest{}, fmt.Errorf("invalid version %q in %q", version, ref)
+		}
+		found := false
+		for _, m := range manifests {
+			if m.Version == v {
+				manifest, found = m, true
+				break
+			}
+		}
+		if !found {
+			return nil, Manifest{}, fmt.Errorf("%s@%d not found in %s", name, v, r.Root)
+		}
+	}
+
+	f, err := os.Open(filepath.Join(r.Root, name, strconv.Itoa(manifest.Version), modelFile))
+	if err != nil {
+		return nil, Manifest{}, err
+	}
+	defer f.Close()
+	mc, err := LoadMarkovChain(f)
+	if err != nil {
+		return nil, Manifest{}, fmt.Errorf("%s: %v", manifest.Ref(), err)
+	}
+	return mc, manifest, nil
+}
+
+// runPublish implements the "publish" subcommand: train a chain and store
+// it as the next version of a named model.
+func runPublish(args []string) {
+	fs := flag.NewFlagSet("publish", flag.ExitOnError)
+	k := fs.Int("k", 1, "Order of the Markov chain")
+	inputFile := fs.String("i", "", "Input file (optional, reads from stdin if not provided)")
+	registryDir := fs.String("registry", "models", "Registry directory")
+	name := fs.String("name", "", "Model name to publish under")
+	topN := fs.Int("top-n", 0, "Keep only the N most frequent next characters of each state (0 keeps all)")
+	trainLog := fs.String("train-log", "", "Append every trained transition to this log file")
+	newlines := fs.String("newlines", "lf", "Newline handling for training text: preserve, lf, normalize or boundary")
+	fs.Parse(args)
+
+	mode, err := ParseNewlineMode(*newlines)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if *name == "" {
+		fmt.Fprintf(os.Stderr, "Error: -name is required\n")
+		os.Exit(1)
+	}
+
+	text, err := readInput(*inputFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading input: %v\n", err)
+		os.Exit(1)
+	}
+
+	mc := NewMarkovChain(*k)
+	if *trainLog != "" {
+		log, f, err := openTrainingLog(*trainLog)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error opening training log: %v\n", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		mc.SetLog(log)
+	}
+	mc.AddTextNewlines(text, mode)
+	mc.PruneTopN(*topN)
+	if mc.log != nil && mc.log.Err() != nil {
+		fmt.Fprintf(os.Stderr, "Error writing training log: %v\n", mc.log.Err())
+		os.Exit(1)
+	}
+
+	manifest, err := NewRegistry(*registryDir).Publish(*name, mc, *inputFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error publishing model: %v\n", err)
+		os.Exit(1)
+	}
+	for _, w := range manifest.Warnings {
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", w)
+	}
+	fmt.Println(manifest.Ref())
+}
+
+// runList implements the "list" subcommand: show the published versions of
+// one model, or of every model when no name is given.
+func runList(args []string) {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	registryDir := fs.String("registry", "models", "Registry directory")
+	fs.Parse(args)
+
+	manifests, err := NewRegistry(*registryDir).List(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error listing models: %v\n", err)
+		os.Exit(1)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "model\torder\tstates\ttransitions\tpublished")
+	for _, m := range manifests {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%s\n", m.Ref(), m.Order, m.States, m.Transitions, m.Published.Format(time.RFC3339))
+	}
+	w.Flush()
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestRegistryPublishListLoad(t *testing.T) {
+	r := NewRegistry(t.TempDir())
+
+	first := NewMarkovChain(2)
+	first.AddText("the cat sat on the mat")
+	second := NewMarkovChain(3)
+	second.AddText("the dog sat on the log")
+	for i, mc := range []*MarkovChain{first, second} {
+		m, err := r.Publish("animals", mc, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Version != i+1 {
+			t.Fatalf("publish %d: got version %d", i+1, m.Version)
+		}
+	}
+
+	// An interrupted publish leaves a version directory without a manifest
+	if err := os.Mkdir(filepath.Join(r.Root, "animals", "3"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	manifests, err := r.List("animals")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifests) != 2 || manifests[0].Ref() != "animals@1" || manifests[1].Ref() != "animals@2" {
+		t.Fatalf("List: got %v", manifests)
+	}
+
+	for ref, want := range map[string]*MarkovChain{
+		"animals@1":      first,
+		"animals@2":      second,
+		"animals@latest": second,
+		"animals":        second,
+	} {
+		mc, _, err := r.Load(ref)
+		if err != nil {
+			t.Fatalf("Load(%q): %v", ref, err)
+		}
+		if mc.order != want.order || !reflect.DeepEqual(mc.counts(), want.counts()) {
+			t.Errorf("Load(%q): got a different chain", ref)
+		}
+	}
+
+	for _, ref := range []string{"animals@3", "@latest", "@2", "../animals"} {
+		if _, _, err := r.Load(ref); err == nil {
+			t.Errorf("Load(%q): want an error", ref)
+		}
+	}
+
+	// The next publish skips the claimed directory
+	m, err := r.Publish("animals", first, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Version != 4 {
+		t.Errorf("publish after an interrupted one: got version %d, want 4", m.Version)
+	}
+}
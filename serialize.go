@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+)
+
+// savedChain is the on-disk form of a MarkovChain. It mirrors the chain's
+// fields with exported names so encoding/gob can see them.
+type savedChain struct {
+	Order       int
+	Transitions map[string][]rune
+	Pruned      map[string][]int
+}
+
+// Save writes the chain to w in a compact binary (gob) encoding that
+// LoadMarkovChain can read back.
+func (mc *MarkovChain) Save(w io.Writer) error {
+	return gob.NewEncoder(w).Encode(savedChain{
+		Order:       mc.order,
+		Transitions: mc.transitions,
+		Pruned:      mc.pruned,
+	})
+}
+
+// LoadMarkovChain reads a chain previously written by Save.
+func LoadMarkovChain(r io.Reader) (*MarkovChain, error) {
+	var saved savedChain
+	if err := gob.NewDecoder(r).Decode(&saved); err != nil {
+		return nil, err
+	}
+	if saved.Order < 0 {
+		return nil, fmt.Errorf("invalid model order %d", saved.Order)
+	}
+	mc := NewMarkovChain(saved.Order)
+	if saved.Transitions != nil {
+		mc.transitions = saved.Transitions
+	}
+	for state, counts := range saved.Pruned {
+		if len(counts) != len(mc.transitions[state]) {
+			return nil, fmt.Errorf("pruned state %q has %d counts for %d characters", state, len(counts), len(mc.transitions[state]))
+		}
+	}
+	if len(saved.Pruned) > 0 {
+		mc.pruned = saved.Pruned
+	}
+	return mc, nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// snapshotExt is the file extension of snapshots inside a snapshot directory.
+const snapshotExt = ".snapshot"
+
+// writeFileAtomic writes whatever write produces to path, so that readers
+// only ever see the previous file or the complete new one. The data goes
+// to a temporary file in the same directory, is flushed to disk, and is
+// then renamed over path.
+func writeFileAtomic(path string, write func(io.Writer) error) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	// Clean up the temporary file on any failure before the rename
+	defer os.Remove(tmp.Name())
+
+	// CreateTemp makes the file private; give it the usual permissions
+	if err := tmp.Chmod(0o644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := write(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	// Persist the rename itself; not every platform can sync a directory
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// SaveSnapshot durably stores mc in dir under the given name, replacing
+// any earlier snapshot of that name only once the new one is complete. The
+// chain must not be modified while the snapshot is being written.
+func SaveSnapshot(dir, name string, mc *MarkovChain) error {
+	if err := validateName(name); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(dir, name+snapshotExt), mc.Save)
+}
+
+// LoadSnapshot restores the chain stored in dir under the given name. For
+// a saved window, that is the chain of the window at the time it was saved.
+func LoadSnapshot(dir, name string) (*MarkovChain, error) {
+	data, err := readSnapshot(dir, name)
+	if err != nil {
+		return nil, err
+	}
+	return LoadMarkovChain(bytes.NewReader(data))
+}
+
+// SaveWindowSnapshot durably stores a windowed chain like SaveSnapshot,
+// characters and arrival times included, so that a stream can resume from
+// it with LoadWindowSnapshot and expire its counts as if never stopped.
+func SaveWindowSnapshot(dir, name string, w *WindowedChain) error {
+	if err := validateName(name); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(dir, name+snapshotExt), w.Save)
+}
+
+// LoadWindowSnapshot restores the windowed chain stored in dir under the
+// given name by SaveWindowSnapshot.
+func LoadWindowSnapshot(dir, name string) (*WindowedChain, error) {
+	data, err := readSnapshot(dir, name)
+	if err != nil {
+		return nil, err
+	}
+	return LoadWindowedChain(bytes.NewReader(data))
+}
+
+// readSnapshot returns the raw contents of a named snapshot.
+func readSnapshot(dir, name string) ([]byte, error) {
+	if err := validateName(name); err != nil {
+		return nil, err
+	}
+	return os.ReadFile(filepath.Join(dir, name+snapshotExt))
+}
+
+// ListSnapshots returns the names of the snapshots in dir, sorted.
+func ListSnapshots(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		// Skip half-written temporaries, which start with a dot
+		name := entry.Name()
+		if !entry.IsDir() && !strings.HasPrefix(name, ".") && strings.HasSuffix(name, snapshotExt) {
+			names = append(names, strings.TrimSuffix(name, snapshotExt))
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// runSnapshot implements the "snapshot" subcommand: train a chain and save
+// it as a named snapshot, or list the snapshots in a directory.
+func runSnapshot(args []string) {
+	fs := flag.NewFlagSet("snapshot", flag.ExitOnError)
+	k := fs.Int("k", 1, "Order of the Markov chain")
+	inputFile := fs.String("i", "", "Input file (optional, reads from stdin if not provided)")
+	dir := fs.String("dir", "snapshots", "Snapshot directory")
+	name := fs.String("name", "", "Snapshot name to save under, replacing any earlier one")
+	list := fs.Bool("list", false, "List the snapshots in -dir instead of saving one")
+	topN := fs.Int("top-n", 0, "Keep only the N most frequent next characters of each state (0 keeps all)")
+	newlines := fs.String("newlines", "lf", "Newline handling for training text: preserve, lf, normalize or boundary")
+	fs.Parse(args)
+
+	if *list {
+		names, err := ListSnapshots(*dir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error listing snapshots: %v\n", err)
+			os.Exit(1)
+		}
+		for _, name := range names {
+			fmt.Println(name)
+		}
+		return
+	}
+
+	mode, err := ParseNewlineMode(*newlines)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if *name == "" {
+		fmt.Fprintf(os.Stderr, "Error: -name is required\n")
+		os.Exit(1)
+	}
+
+	text, err := readInput(*inputFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading input: %v\n", err)
+		os.Exit(1)
+	}
+
+	mc := NewMarkovChain(*k)
+	mc.AddTextNewlines(text, mode)
+	mc.PruneTopN(*topN)
+	if err := SaveSnapshot(*dir, *name, mc); err != nil {
+		fmt.Fprintf(os.Stderr, "Error saving snapshot: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Println(filepath.Join(*dir, *name+snapshotExt))
+}
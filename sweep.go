@@ -0,0 +1,114 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// parseOrders reads a list of chain orders such as "1..10", "2,3,5" or a
+// mix of both ("1..3,6"). Every order must be at least 1.
+func parseOrders(spec string) ([]int, error) {
+	var orders []int
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		lo, hi := part, part
+		if i := strings.Index(part, ".."); i >= 0 {
+			lo, hi = part[:i], part[i+2:]
+		}
+		from, err := strconv.Atoi(lo)
+		if err != nil {
+			return nil, fmt.Errorf("invalid order %q", lo)
+		}
+		to, err := strconv.Atoi(hi)
+		if err != nil {
+			return nil, fmt.Errorf("invalid order %q", hi)
+		}
+		if from < 1 || to < from {
+			return nil, fmt.Errorf("invalid order range %q", part)
+		}
+		for k := from; k <= to; k++ {
+			orders = append(orders, k)
+		}
+	}
+	if len(orders) == 0 {
+		return nil, fmt.Errorf("no orders given")
+	}
+	return orders, nil
+}
+
+// runSweep implements the "sweep" subcommand: train one chain per order on
+// the same corpus and report held-out perplexity, model size and a sample
+// for each, so the order can be picked from data rather than by guessing.
+func runSweep(args []string) {
+	fs := flag.NewFlagSet("sweep", flag.ExitOnError)
+	inputFile := fs.String("i", "", "Input file (optional, reads from stdin if not provided)")
+	ordersFlag := fs.String("orders", "1..6", "Orders to evaluate, e.g. 1..10 or 1,2,4")
+	holdout := fs.Float64("holdout", 0.1, "Fraction of the corpus (taken from the end) held out for scoring")
+	addK := fs.Float64("addk", 1, "Additive smoothing used when scoring unseen transitions")
+	alpha := fs.Float64("alpha", 0, "Dirichlet prior concentration used for scoring instead of -addk")
+	alphabet := fs.String("alphabet", "", `Characters the Dirichlet prior ranges over on top of the training alphabet (accepts \n, \t, \r)`)
+	l := fs.Int("l", 60, "Number of characters in each sample output")
+	seedFlag := fs.Int64("seed", -1, "Random seed for the samples (optional, defaults to current time if not provided)")
+	newlines := fs.String("newlines", "lf", "Newline handling for training text: preserve, lf, normalize or boundary")
+	fs.Parse(args)
+
+	mode, err := ParseNewlineMode(*newlines)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	orders, err := parseOrders(*ordersFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error parsing -orders: %v\n", err)
+		os.Exit(1)
+	}
+
+	text, err := readInput(*inputFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading input: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Score on text cleaned up the way the chain is trained
+	text = mode.Clean(text)
+	train, heldOut := SplitHoldout(text, *holdout)
+	if heldOut == "" {
+		fmt.Fprintf(os.Stderr, "Error: held-out split is empty, increase -holdout or the corpus size\n")
+		os.Exit(1)
+	}
+
+	smoothing := smoothingFromFlags(*addK, *alpha, unescapeFlag(*alphabet))
+
+	// One row per order, aligned for reading in a terminal
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "order\tperplexity\tstates\ttransitions\twarnings\tsample")
+	for _, k := range orders {
+		mc := NewMarkovChain(k)
+		mc.AddTextNewlines(train, mode)
+
+		ppl := mc.Perplexity(heldOut, smoothing)
+		states, transitions := mc.Size()
+		sample := mc.Generate(*l, *seedFlag, "")
+
+		// Name the failed diversity checks, if any
+		codes := "-"
+		if warnings := mc.CheckDiversity(DefaultDiversityThresholds); len(warnings) > 0 {
+			var names []string
+			for _, warning := range warnings {
+				names = append(names, warning.Code)
+			}
+			codes = strings.Join(names, ",")
+		}
+
+		fmt.Fprintf(w, "%d\t%.3f\t%d\t%d\t%s\t%s\n", k, ppl, states, transitions, codes, strconv.Quote(sample))
+	}
+	w.Flush()
+}
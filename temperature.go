@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// temperatureFor returns the sampling temperature for state: the per-state
+// override if there is a valid one, otherwise the global temperature, with
+// zero meaning the neutral 1.
+func (opts GenerateOptions) temperatureFor(state string) float64 {
+	if opts.StateTemperature != nil {
+		if t, ok := opts.StateTemperature(state); ok && t > 0 {
+			return t
+		}
+	}
+	if opts.Temperature > 0 {
+		return opts.Temperature
+	}
+	return 1
+}
+
+// applyTemperature reshapes a distribution by raising every probability to
+// the power 1/t and renormalizing: t below 1 favours the likely characters
+// (conservative), t above 1 flattens towards uniform (creative). A nil
+// weights means uniform draws over runes, which may repeat; those repeats
+// are folded into counts first.
+func applyTemperature(runes []rune, weights []float64, t float64) ([]rune, []float64) {
+	if weights == nil {
+		// Fold the flat list into counts, keeping first-appearance order
+		index := make(map[rune]int)
+		var distinct []rune
+		for _, r := range runes {
+			if _, ok := index[r]; !ok {
+				index[r] = len(distinct)
+				distinct = append(distinct, r)
+				weights = append(weights, 0)
+			}
+			weights[index[r]]++
+		}
+		runes = distinct
+	}
+
+	// Work relative to the largest weight in log space, so a small t
+	// cannot overflow
+	maxLog := math.Inf(-1)
+	for _, w := range weights {
+		maxLog = math.Max(maxLog, math.Log(w))
+	}
+	reshaped := make([]float64, len(weights))
+	for i, w := range weights {
+		reshaped[i] = math.Exp((math.Log(w) - maxLog) / t)
+	}
+	return runes, reshaped
+}
+
+// SuffixTemperatures turns a map of state suffixes to temperatures into a
+// GenerateOptions.StateTemperature callback. A state takes the temperature
+// of its longest suffix found in the map, so the key "." covers every
+// state ending in a period, whatever the chain's order.
+func SuffixTemperatures(temps map[string]float64) func(state string) (float64, bool) {
+	return func(state string) (float64, bool) {
+		for i := 0; i <= len(state); i++ {
+			if t, ok := temps[state[i:]]; ok {
+				return t, true
+			}
+		}
+		return 0, false
+	}
+}
+
+// stateTempFlag collects repeated -state-temp SUFFIX=T flags.
+type stateTempFlag map[string]float64
+
+// String implements flag.Value.
+func (f stateTempFlag) String() string {
+	suffixes := make([]string, 0, len(f))
+	for suffix := range f {
+		suffixes = append(suffixes, suffix)
+	}
+	sort.Strings(suffixes)
+	var parts []string
+	for _, suffix := range suffixes {
+		parts = append(parts, fmt.Sprintf("%q=%g", suffix, f[suffix]))
+	}
+	return strings.Join(parts, ",")
+}
+
+// Set implements flag.Value. The value splits on its last '=', so the
+// suffix itself may contain one, and accepts the same escapes as -stop.
+func (f stateTempFlag) Set(value string) error {
+	i := strings.LastIndex(value, "=")
+	if i < 0 {
+		return fmt.Errorf("want SUFFIX=TEMPERATURE, got %q", value)
+	}
+	t, err := strconv.ParseFloat(value[i+1:], 64)
+	if err != nil || t <= 0 {
+		return fmt.Errorf("invalid temperature %q", value[i+1:])
+	}
+	f[unescapeFlag(value[:i])] = t
+	return nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// TrainingLog records every change to a chain's transition counts as an
+// append-only stream of lines:
+//
+//	<quoted state>\t<quoted character>\t<delta>
+//
+// Replaying the lines in order with ApplyLog rebuilds the chain's counts,
+// so a consumer can follow a model by tailing its log instead of reloading
+// a full save. The rebuilt chain stores its transitions in a different
+// order, so it generates different text for a given seed, though with the
+// same probabilities. States and characters are Go-quoted, so tabs,
+// newlines and non-UTF-8 bytes survive the round trip.
+type TrainingLog struct {
+	w   io.Writer
+	err error
+}
+
+// NewTrainingLog returns a log that appends to w.
+func NewTrainingLog(w io.Writer) *TrainingLog {
+	return &TrainingLog{w: w}
+}
+
+// Err returns the first error met while writing, if any. Once an error
+// occurs, nothing more is written.
+func (l *TrainingLog) Err() error {
+	return l.err
+}
+
+// Record writes one batch of count changes, in a fixed order. The whole
+// batch goes out in a single write so batches never interleave.
+func (l *TrainingLog) Record(deltas map[string]map[rune]int) {
+	if l.err != nil || len(deltas) == 0 {
+		return
+	}
+	states := make([]string, 0, len(deltas))
+	for state := range deltas {
+		states = append(states, state)
+	}
+	sort.Strings(states)
+
+	var buf bytes.Buffer
+	for _, state := range states {
+		runes := make([]rune, 0, len(deltas[state]))
+		for r := range deltas[state] {
+			runes = append(runes, r)
+		}
+		sort.Slice(runes, func(i, j int) bool { return runes[i] < runes[j] })
+		for _, r := range runes {
+			if d := deltas[state][r]; d != 0 {
+				fmt.Fprintf(&buf, "%s\t%s\t%d\n", strconv.Quote(state), strconv.QuoteRune(r), d)
+			}
+		}
+	}
+	_, l.err = l.w.Write(buf.Bytes())
+}
+
+// SetLog makes the chain record every later change to its counts in log.
+// Pass nil to stop logging.
+func (mc *MarkovChain) SetLog(log *TrainingLog) {
+	mc.log = log
+}
+
+// adjust changes how many times next is stored after state by delta,
+// dropping the state once it has no transitions left. It returns the
+// change actually made, which is smaller than a negative delta asks for
+// when there are not that many occurrences to remove.
+func (mc *MarkovChain) adjust(state string, next rune, delta int) int {
+	if _, ok := mc.pruned[state]; ok {
+		return mc.adjustPruned(state, next, delta)
+	}
+	if delta >= 0 {
+		for i := 0; i < delta; i++ {
+			mc.transitions[state] = append(mc.transitions[state], next)
+		}
+		return delta
+	}
+
+	// Remove occurrences from the end of the list, keeping the rest in order
+	nextRunes := mc.transitions[state]
+	removed := 0
+	for i := len(nextRunes) - 1; i >= 0 && removed < -delta; i-- {
+		if nextRunes[i] == next {
+			nextRunes = append(nextRunes[:i], nextRunes[i+1:]...)
+			removed++
+		}
+	}
+	if len(nextRunes) == 0 {
+		delete(mc.transitions, state)
+	} else {
+		mc.transitions[state] = nextRunes
+	}
+	return -removed
+}
+
+// ApplyLog reads training-log lines from r until EOF and applies each
+// change to the chain. Every state in the log must match the chain's
+// order. Changes applied this way are not themselves logged.
+func (mc *MarkovChain) ApplyLog(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if scanner.Text() == "" {
+			continue
+		}
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) != 3 {
+			return fmt.Errorf("log line %d: want 3 tab-separated fields, got %d", line, len(fields))
+		}
+		state, err := strconv.Unquote(fields[0])
+		if err != nil {
+			return fmt.Errorf("log line %d: bad state: %v", line, err)
+		}
+		if len(state) != mc.order {
+			return fmt.Errorf("log line %d: state %s does not match order %d", line, fields[0], mc.order)
+		}
+		char, err := strconv.Unquote(fields[1])
+		next, size := utf8.DecodeRuneInString(char)
+		if err != nil || size == 0 || size != len(char) {
+			return fmt.Errorf("log line %d: bad character %s", line, fields[1])
+		}
+		delta, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return fmt.Errorf("log line %d: bad delta: %v", line, err)
+		}
+		mc.adjust(state, next, delta)
+	}
+	return scanner.Err()
+}
+
+// openTrainingLog opens path for appending, creating it if needed, and
+// wraps it in a TrainingLog.
+func openTrainingLog(path string) (*TrainingLog, *os.File, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, nil, err
+	}
+	return NewTrainingLog(f), f, nil
+}
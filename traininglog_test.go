@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTrainingLogReplayRebuildsCounts(t *testing.T) {
+	// Tabs, newlines, quotes, backslashes and bytes that are not UTF-8
+	// must all survive quoting
+	texts := []string{
+		strings.Repeat("the cat sat on the mat.\n", 5),
+		"tab\there, \"quoted\" and 'single', back\\slash\r\n",
+		"bytes \xff\xfe\x80 and \xc3\xa9 too\n",
+	}
+
+	for _, order := range []int{0, 1, 3} {
+		var log bytes.Buffer
+		mc := NewMarkovChain(order)
+		mc.SetLog(NewTrainingLog(&log))
+		for _, text := range texts {
+			mc.AddText(text)
+		}
+		if mc.PruneTopN(1) == 0 {
+			t.Fatalf("order %d: pruning removed nothing, so negative deltas go untested", order)
+		}
+		// More training after pruning is logged too
+		mc.AddText("the end\n")
+		if err := mc.log.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(log.String(), "\t-") {
+			t.Fatalf("order %d: no negative deltas in the log", order)
+		}
+
+		replayed := NewMarkovChain(order)
+		if err := replayed.ApplyLog(&log); err != nil {
+			t.Fatalf("order %d: %v", order, err)
+		}
+		if got, want := replayed.counts(), mc.counts(); !reflect.DeepEqual(got, want) {
+			t.Errorf("order %d: replayed counts %v, want %v", order, got, want)
+		}
+	}
+}
+
+func TestApplyLogRejectsWrongOrder(t *testing.T) {
+	var log bytes.Buffer
+	mc := NewMarkovChain(2)
+	mc.SetLog(NewTrainingLog(&log))
+	mc.AddText("hello")
+
+	if err := NewMarkovChain(3).ApplyLog(&log); err == nil {
+		t.Error("ApplyLog accepted a log of another order")
+	}
+}
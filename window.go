@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bufio"
+	"encoding/gob"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// windowEntry is one trained character of a stream and when it arrived.
+type windowEntry struct {
+	char byte
+	at   time.Time
+}
+
+// WindowedChain trains a chain on a stream but only keeps counts for the
+// most recent input: the last MaxTokens characters, the characters that
+// arrived within MaxAge, or both. Every character is remembered in a ring
+// buffer, and when one expires the transition that started with it is
+// subtracted from the chain again, so the chain always matches what a
+// fresh chain trained on the window would hold.
+type WindowedChain struct {
+	chain *MarkovChain
+	// MaxTokens caps the window in characters; zero means no cap.
+	MaxTokens int
+	// MaxAge caps the window in time; zero means no cap.
+	MaxAge time.Duration
+
+	// ring holds the window's characters, oldest at head
+	ring []windowEntry
+	head int
+	size int
+}
+
+// NewWindowedChain returns an empty windowed chain of the given order.
+func NewWindowedChain(order, maxTokens int, maxAge time.Duration) *WindowedChain {
+	return &WindowedChain{
+		chain:     NewMarkovChain(order),
+		MaxTokens: maxTokens,
+		MaxAge:    maxAge,
+	}
+}
+
+// Chain returns the chain holding the window's counts, for generating or
+// scoring. It must not be trained directly, or the window bookkeeping no
+// longer matches its counts.
+func (w *WindowedChain) Chain() *MarkovChain {
+	return w.chain
+}
+
+// Len returns how many characters are currently in the window.
+func (w *WindowedChain) Len() int {
+	return w.size
+}
+
+// at returns the i-th oldest character in the window.
+func (w *WindowedChain) at(i int) windowEntry {
+	return w.ring[(w.head+i)%len(w.ring)]
+}
+
+// stateAt returns the state made of the 'order' characters starting at
+// the i-th oldest character in the window.
+func (w *WindowedChain) stateAt(i int) string {
+	state := make([]byte, w.chain.order)
+	for j := range state {
+		state[j] = w.at(i + j).char
+	}
+	return string(state)
+}
+
+// change applies a count change to the chain and notes it for the log.
+func (w *WindowedChain) change(deltas map[string]map[rune]int, state string, next rune, delta int) {
+	delta = w.chain.adjust(state, next, delta)
+	if deltas != nil && delta != 0 {
+		if deltas[state] == nil {
+			deltas[state] = make(map[rune]int)
+		}
+		deltas[state][next] += delta
+	}
+}
+
+// dropOldest removes the oldest character from the window, along with the
+// one transition whose state starts with it, if the window holds it.
+func (w *WindowedChain) dropOldest(deltas map[string]map[rune]int) {
+	if w.size > w.chain.order {
+		w.change(deltas, w.stateAt(0), rune(w.at(w.chain.order).char), -1)
+	}
+	w.head = (w.head + 1) % len(w.ring)
+	w.size--
+}
+
+// push adds a character as the newest in the window, growing the ring
+// when it is full, along with the transition it completes.
+func (w *WindowedChain) push(deltas map[string]map[rune]int, e windowEntry) {
+	if w.size == len(w.ring) {
+		grown := make([]windowEntry, 2*len(w.ring)+16)
+		for i := 0; i < w.size; i++ {
+			grown[i] = w.at(i)
+		}
+		w.ring, w.head = grown, 0
+	}
+	w.ring[(w.head+w.size)%len(w.ring)] = e
+	w.size++
+
+	if w.size > w.chain.order {
+		w.change(deltas, w.stateAt(w.size-w.chain.order-1), rune(e.char), 1)
+	}
+}
+
+// newDeltas returns a map to gather changes in when the chain is logging.
+func (w *WindowedChain) newDeltas() map[string]map[rune]int {
+	if w.chain.log == nil {
+		return nil
+	}
+	return make(map[string]map[rune]int)
+}
+
+// Add appends text to the stream as arriving now.
+func (w *WindowedChain) Add(text string) {
+	w.AddAt(text, time.Now())
+}
+
+// AddAt appends text to the stream as arriving at the given time, then
+// expires whatever falls outside the window. The chain's training log, if
+// any, receives the additions and expirations as one batch.
+func (w *WindowedChain) AddAt(text string, at time.Time) {
+	deltas := w.newDeltas()
+	for i := 0; i < len(text); i++ {
+		// Make room first, so the ring never outgrows a token cap
+		if w.MaxTokens > 0 && w.size >= w.MaxTokens {
+			w.dropOldest(deltas)
+		}
+		w.push(deltas, windowEntry{char: text[i], at: at})
+	}
+	w.expire(deltas, at)
+	if deltas != nil {
+		w.chain.log.Record(deltas)
+	}
+}
+
+// Expire drops every character older than MaxAge as of now, and any
+// beyond MaxTokens if it was lowered. AddAt already does this; call it
+// directly when time passes without new input.
+func (w *WindowedChain) Expire(now time.Time) {
+	deltas := w.newDeltas()
+	w.expire(deltas, now)
+	if deltas != nil {
+		w.chain.log.Record(deltas)
+	}
+}
+
+// expire is Expire without the logging wrapper.
+func (w *WindowedChain) expire(deltas map[string]map[rune]int, now time.Time) {
+	for w.MaxTokens > 0 && w.size > w.MaxTokens {
+		w.dropOldest(deltas)
+	}
+	if w.MaxAge <= 0 {
+		return
+	}
+	cutoff := now.Add(-w.MaxAge)
+	for w.size > 0 && w.at(0).at.Before(cutoff) {
+		w.dropOldest(deltas)
+	}
+}
+
+// savedWindow is the on-disk form of a WindowedChain: the characters in
+// the window and when each arrived, from which the counts are rebuilt.
+// Order and Transitions match savedChain, so LoadMarkovChain (and
+// LoadSnapshot) read a saved window as the chain of its current window.
+type savedWindow struct {
+	Order       int
+	Transitions map[string][]rune
+	MaxTokens   int
+	MaxAge      time.Duration
+	Chars       []byte
+	Times       []time.Time
+}
+
+// Save writes the window to out in a gob encoding that LoadWindowedChain
+// can read back. The window must not be modified while it is being saved.
+func (w *WindowedChain) Save(out io.Writer) error {
+	saved := savedWindow{
+		Order:       w.chain.order,
+		Transitions: w.chain.transitions,
+		MaxTokens:   w.MaxTokens,
+		MaxAge:      w.MaxAge,
+		Chars:       make([]byte, w.size),
+		Times:       make([]time.Time, w.size),
+	}
+	for i := 0; i < w.size; i++ {
+		e := w.at(i)
+		saved.Chars[i], saved.Times[i] = e.char, e.at
+	}
+	return gob.NewEncoder(out).Encode(saved)
+}
+
+// LoadWindowedChain reads a window previously written by
+// WindowedChain.Save, rebuilding its counts from the saved characters. A
+// plain saved chain is rejected, since it lacks the characters needed to
+// expire its counts later.
+func LoadWindowedChain(r io.Reader) (*WindowedChain, error) {
+	var saved savedWindow
+	if err := gob.NewDecoder(r).Decode(&saved); err != nil {
+		return nil, err
+	}
+	if saved.Order < 0 {
+		return nil, fmt.Errorf("invalid model order %d", saved.Order)
+	}
+	if len(saved.Times) != len(saved.Chars) {
+		return nil, fmt.Errorf("saved window has %d characters but %d times", len(saved.Chars), len(saved.Times))
+	}
+	if len(saved.Chars) == 0 && len(saved.Transitions) > 0 {
+		return nil, fmt.Errorf("not a saved window: it holds a chain but no window characters")
+	}
+
+	w := NewWindowedChain(saved.Order, saved.MaxTokens, saved.MaxAge)
+	for i, c := range saved.Chars {
+		w.push(nil, windowEntry{char: c, at: saved.Times[i]})
+	}
+	return w, nil
+}
+
+// lineCleaner applies a newline mode to a stream one line at a time. In
+// normalize mode it remembers whether the last line was blank, so a run of
+// blank lines still collapses to one across lines, as NormalizeText does
+// for a whole text.
+type lineCleaner struct {
+	mode      NewlineMode
+	prevBlank bool
+}
+
+// Clean returns line cleaned up according to the mode.
+func (c *lineCleaner) Clean(line string) string {
+	switch c.mode {
+	case NewlinesPreserve:
+		return line
+	case NewlinesLF:
+		return NormalizeLineEndings(line)
+	}
+
+	// A lone CR can split the line further, so go part by part
+	line = strings.ReplaceAll(NormalizeLineEndings(line), "\t", " ")
+	var out strings.Builder
+	for _, part := range strings.SplitAfter(line, "\n") {
+		if part == "" {
+			continue
+		}
+		blank := strings.TrimSpace(part) == ""
+		if blank {
+			if c.prevBlank {
+				continue
+			}
+			// Keep just the line break of a whitespace-only line
+			part = part[len(strings.TrimRight(part, "\n")):]
+		}
+		out.WriteString(part)
+		c.prevBlank = blank
+	}
+	return out.String()
+}
+
+// runStream implements the "stream" subcommand: train a windowed chain on
+// stdin line by line, and print a sample every few lines, so the output
+// follows whatever the stream has been saying recently.
+func runStream(args []string) {
+	fs := flag.NewFlagSet("stream", flag.ExitOnError)
+	k := fs.Int("k", 1, "Order of the Markov chain")
+	window := fs.Int("window", 10000, "Keep only the last N characters of the stream (0 for no limit)")
+	windowTime := fs.Duration("window-time", 0, "Keep only characters that arrived within this duration, e.g. 10m (0 for no limit)")
+	every := fs.Int("every", 10, "Print a sample after every N lines")
+	l := fs.Int("l", 100, "Number of characters in each sample")
+	seedFlag := fs.Int64("seed", -1, "Random seed of the first sample (optional, defaults to current time if not provided)")
+	trainLog := fs.String("train-log", "", "Append every count change, expirations included, to this log file")
+	newlines := fs.String("newlines", "lf", "Newline handling for each line: preserve, lf or normalize")
+	snapshot := fs.String("snapshot", "", "Resume from this snapshot if it exists, and keep it up to date")
+	snapshotDir := fs.String("snapshot-dir", "snapshots", "Snapshot directory used with -snapshot")
+	snapshotEvery := fs.Int("snapshot-every", 100, "Write the snapshot after every N lines, as well as at the end")
+	fs.Parse(args)
+
+	mode, err := ParseNewlineMode(*newlines)
+	if err == nil && mode == NewlinesBoundary {
+		err = fmt.Errorf("boundary mode is not supported when streaming")
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if *window <= 0 && *windowTime <= 0 {
+		fmt.Fprintf(os.Stderr, "Error: set -window or -window-time, or the model never forgets\n")
+		os.Exit(1)
+	}
+	if *every < 1 {
+		*every = 1
+	}
+	if *snapshotEvery < 1 {
+		*snapshotEvery = 1
+	}
+
+	// Pick up where a previous run left off, under this run's limits
+	wc := NewWindowedChain(*k, *window, *windowTime)
+	if *snapshot != "" {
+		restored, err := LoadWindowSnapshot(*snapshotDir, *snapshot)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+		case err != nil:
+			fmt.Fprintf(os.Stderr, "Error loading snapshot: %v\n", err)
+			os.Exit(1)
+		case restored.Chain().order != *k:
+			fmt.Fprintf(os.Stderr, "Error: snapshot %q has order %d, not %d\n", *snapshot, restored.Chain().order, *k)
+			os.Exit(1)
+		default:
+			restored.MaxTokens, restored.MaxAge = *window, *windowTime
+			wc = restored
+		}
+	}
+	saveSnapshot := func() {
+		if *snapshot == "" {
+			return
+		}
+		if err := SaveWindowSnapshot(*snapshotDir, *snapshot, wc); err != nil {
+			fmt.Fprintf(os.Stderr, "Error saving snapshot: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if *trainLog != "" {
+		log, f, err := openTrainingLog(*trainLog)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error opening training log: %v\n", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		wc.Chain().SetLog(log)
+	}
+
+	// Whatever expired while stopped goes now, logged like any other change
+	wc.Expire(time.Now())
+
+	cleaner := lineCleaner{mode: mode}
+	reader := bufio.NewReader(os.Stdin)
+	seed := ResolveSeed(*seedFlag)
+	for lines := 1; ; lines++ {
+		line, err := reader.ReadString('\n')
+		if line != "" {
+			wc.Add(cleaner.Clean(line))
+			if log := wc.Chain().log; log != nil && log.Err() != nil {
+				fmt.Fprintf(os.Stderr, "Error writing training log: %v\n", log.Err())
+				os.Exit(1)
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			saveSnapshot()
+			break
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading input: %v\n", err)
+			os.Exit(1)
+		}
+
+		if lines%*every == 0 {
+			wc.Expire(time.Now())
+			fmt.Println(wc.Chain().Generate(*l, seed, ""))
+			seed = (seed + 1) & (1<<63 - 1)
+		}
+		if lines%*snapshotEvery == 0 {
+			saveSnapshot()
+		}
+	}
+}
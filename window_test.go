@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// windowText is a stream with enough repetition for transitions to be
+// added and expired many times over.
+const windowText = "the cat sat on the mat.\nthe dog sat on the log.\n\tand then the cat ate the rat!\n"
+
+func TestWindowedChainTokenCapMatchesFreshChain(t *testing.T) {
+	stream := strings.Repeat(windowText, 5)
+	for _, order := range []int{0, 1, 3} {
+		for _, limit := range []int{1, 2, 5, 40, 1000} {
+			wc := NewWindowedChain(order, limit, 0)
+			for start := 0; start < len(stream); start += 7 {
+				end := start + 7
+				if end > len(stream) {
+					end = len(stream)
+				}
+				wc.Add(stream[start:end])
+
+				window := stream[:end]
+				if len(window) > limit {
+					window = window[len(window)-limit:]
+				}
+				fresh := NewMarkovChain(order)
+				fresh.AddText(window)
+				if got, want := wc.Chain().counts(), fresh.counts(); !reflect.DeepEqual(got, want) {
+					t.Fatalf("order %d, limit %d, after %d characters: counts %v, want %v", order, limit, end, got, want)
+				}
+				if wc.Len() != len(window) {
+					t.Fatalf("order %d, limit %d: Len %d, want %d", order, limit, wc.Len(), len(window))
+				}
+			}
+		}
+	}
+}
+
+func TestWindowedChainTimeCapMatchesFreshChain(t *testing.T) {
+	lines := strings.SplitAfter(strings.Repeat(windowText, 4), "\n")
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, order := range []int{1, 2} {
+		wc := NewWindowedChain(order, 0, 3*time.Minute)
+		for i, line := range lines {
+			// One line a minute, so the window holds the last four lines
+			// (the one at exactly three minutes old is kept)
+			wc.AddAt(line, start.Add(time.Duration(i)*time.Minute))
+
+			first := i - 3
+			if first < 0 {
+				first = 0
+			}
+			fresh := NewMarkovChain(order)
+			fresh.AddText(strings.Join(lines[first:i+1], ""))
+			if got, want := wc.Chain().counts(), fresh.counts(); !reflect.DeepEqual(got, want) {
+				t.Fatalf("order %d, line %d: counts %v, want %v", order, i, got, want)
+			}
+		}
+
+		// With no new input, everything eventually expires
+		wc.Expire(start.Add(time.Duration(len(lines)+3) * time.Minute))
+		if wc.Len() != 0 || len(wc.Chain().transitions) != 0 {
+			t.Fatalf("order %d: %d characters and %d states left after expiry", order, wc.Len(), len(wc.Chain().transitions))
+		}
+	}
+}
+
+func TestLineCleanerMatchesNormalizeText(t *testing.T) {
+	text := "one\r\n\r\n \t \r\n\ntwo\tthree\rfour\n\n\n\nend\n"
+	c := lineCleaner{mode: NewlinesNormalize}
+	var got strings.Builder
+	for _, line := range strings.SplitAfter(text, "\n") {
+		got.WriteString(c.Clean(line))
+	}
+	if want := NormalizeText(text); got.String() != want {
+		t.Errorf("line by line: %q, want %q", got.String(), want)
+	}
+}
+
+func TestWindowedChainSaveResumes(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	lines := strings.SplitAfter(strings.Repeat(windowText, 3), "\n")
+	half := len(lines) / 2
+
+	// One window fed without a break, one saved and restored halfway
+	whole := NewWindowedChain(2, 60, 5*time.Minute)
+	resumed := NewWindowedChain(2, 60, 5*time.Minute)
+	for i, line := range lines {
+		at := start.Add(time.Duration(i) * time.Minute)
+		whole.AddAt(line, at)
+		resumed.AddAt(line, at)
+
+		if i == half {
+			var buf bytes.Buffer
+			if err := resumed.Save(&buf); err != nil {
+				t.Fatal(err)
+			}
+			saved := buf.Bytes()
+
+			// A saved window also reads as the plain chain of the window
+			mc, err := LoadMarkovChain(bytes.NewReader(saved))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(mc.counts(), resumed.Chain().counts()) {
+				t.Fatalf("LoadMarkovChain: counts differ from the saved window's")
+			}
+
+			resumed, err = LoadWindowedChain(bytes.NewReader(saved))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if !reflect.DeepEqual(whole.Chain().counts(), resumed.Chain().counts()) || whole.Len() != resumed.Len() {
+		t.Fatalf("resumed window differs from one never stopped")
+	}
+
+	// A plain chain cannot be resumed as a window
+	var buf bytes.Buffer
+	if err := whole.Chain().Save(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadWindowedChain(&buf); err == nil {
+		t.Errorf("LoadWindowedChain accepted a plain chain")
+	}
+}